@@ -1,10 +1,9 @@
 module github.com/jonny5532/wsgo
 
-go 1.18
-
-require github.com/projecthunt/reuseable v0.0.7
+go 1.24
 
 require (
-	github.com/hashicorp/golang-lru/v2 v2.0.2 // indirect
-	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.2
+	github.com/projecthunt/reuseable v0.0.7
+	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a
 )
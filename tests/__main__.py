@@ -3,6 +3,18 @@ import unittest
 from .basic import *
 from .park import *
 from .block import *
+from .config import *
+from .tls import *
+from .process_manager import *
+from .systemd import *
+from .privileges import *
+from .control import *
+from .cpu_affinity import *
+from .websocket import *
+from .asgi import *
+from .proxy_protocol import *
+from .forwarded import *
+from .streaming import *
 
 print("Testing on", sys.version)
 unittest.main(buffer=True)
@@ -0,0 +1,109 @@
+import hashlib
+import os
+import requests
+import socket
+import subprocess
+import time
+from .utils import WsgoTestCase
+
+class AsgiTests(WsgoTestCase):
+
+    def test_requests(self):
+        self.start('--asgi', '--module', 'asgi_app', '--process', '1')
+        time.sleep(1)
+
+        r = requests.get('http://localhost:8000/path/?a=1', headers={'X-Test': 'yes'})
+        self.assertEqual(r.status_code, 200)
+        self.assertEqual(r.text, 'GET|1.1|http||/path/|a=1|yes|hello|0:d41d8cd98f00b204e9800998ecf8427e')
+
+        # A body spanning several reads
+        body = os.urandom(200000)
+        r = requests.post('http://localhost:8000/', data=body)
+        self.assertTrue(r.text.startswith('POST|'))
+        self.assertTrue(r.text.endswith('|200000:' + hashlib.md5(body).hexdigest()))
+
+        r = requests.get('http://localhost:8000/stream/')
+        self.assertEqual(r.text, 'chunk0 chunk1 chunk2 ')
+
+        r = requests.get('http://localhost:8000/error/')
+        self.assertEqual(r.status_code, 502)
+
+    def test_concurrency(self):
+        self.start('--asgi', '--module', 'asgi_app', '--process', '1', '--workers', '4')
+        time.sleep(1)
+
+        # Requests run concurrently on the event loop, up to the worker count
+        start = time.time()
+        futures = [self.pool.submit(requests.get, 'http://localhost:8000/wait/') for i in range(4)]
+        for f in futures:
+            self.assertEqual(f.result().status_code, 200)
+        self.assertLess(time.time() - start, 1.9)
+
+    def test_timeout(self):
+        self.start('--asgi', '--module', 'asgi_app', '--process', '1', '--request-timeout', '1')
+        time.sleep(1)
+
+        start = time.time()
+        r = requests.get('http://localhost:8000/sleep/')
+        self.assertEqual(r.status_code, 502)
+        self.assertLess(time.time() - start, 3)
+
+        self.assertEqual(requests.get('http://localhost:8000/').status_code, 200)
+
+    def test_timeout_while_sending(self):
+        self.start('--asgi', '--module', 'asgi_app', '--process', '1', '--request-timeout', '2')
+        time.sleep(1)
+
+        # A client that doesn't read the response, so sending blocks
+        s = socket.create_connection(('127.0.0.1', 8000))
+        s.sendall(b'GET /flood/ HTTP/1.1\r\nHost: localhost\r\n\r\n')
+        time.sleep(4)
+
+        # Once the request has timed out, other requests shouldn't be held up
+        # by it
+        start = time.time()
+        self.assertEqual(requests.get('http://localhost:8000/', timeout=10).status_code, 200)
+        self.assertLess(time.time() - start, 2)
+        s.close()
+
+    def test_disconnect(self):
+        self.start('--asgi', '--module', 'asgi_app', '--process', '1')
+        time.sleep(1)
+
+        s = socket.create_connection(('localhost', 8000))
+        s.sendall(b'GET /wait-disconnect/ HTTP/1.1\r\nHost: localhost\r\n\r\n')
+        self.assertIn(b'waiting', s.recv(4096))
+        s.close()
+        time.sleep(0.5)
+
+        self.assertEqual(requests.get('http://localhost:8000/disconnects/').text, '1')
+
+    def test_cache_and_block(self):
+        self.start('--asgi', '--module', 'asgi_app', '--process', '1', '--max-age', '60')
+        time.sleep(1)
+
+        t = requests.get('http://localhost:8000/time/').text
+        self.assertEqual(requests.get('http://localhost:8000/time/').text, t)
+
+        headers = {'X-Forwarded-For': '1.2.3.4'}
+        r = requests.get('http://localhost:8000/block/', headers=headers)
+        self.assertEqual(r.status_code, 200)
+        self.assertNotIn('X-WSGo-Block', r.headers)
+        self.assertEqual(requests.get('http://localhost:8000/', headers=headers).status_code, 429)
+
+    def test_mounts(self):
+        self.start('--asgi', '--mount', '/app=asgi_app', '--mount', '/plain=asgi_app:no_lifespan', '--process', '1')
+        time.sleep(1)
+
+        r = requests.get('http://localhost:8000/app/x')
+        self.assertEqual(r.text, 'GET|1.1|http|/app|/app/x|||hello|0:d41d8cd98f00b204e9800998ecf8427e')
+        self.assertEqual(requests.get('http://localhost:8000/plain/').text, 'no lifespan')
+
+    def test_lifespan_failure(self):
+        p = subprocess.run(
+            ['wsgo', '--asgi', '--module', 'asgi_app:failing_startup', '--process', '1'],
+            cwd=os.path.dirname(__file__),
+            stdout=subprocess.PIPE, stderr=subprocess.PIPE,
+        )
+        self.assertEqual(p.returncode, 27)
+        self.assertIn(b'no database', p.stderr)
@@ -0,0 +1,105 @@
+import asyncio
+import hashlib
+import time
+
+disconnects = 0
+
+async def application(scope, receive, send):
+    if scope['type'] == 'lifespan':
+        return await lifespan(scope, receive, send)
+
+    path = scope['path']
+
+    if path.endswith('/sleep/'):
+        await asyncio.sleep(10)
+    if path.endswith('/wait/'):
+        await asyncio.sleep(1)
+    if path.endswith('/error/'):
+        raise Exception('ASGI application failed')
+    if path.endswith('/stream/'):
+        return await stream(scope, receive, send)
+    if path.endswith('/flood/'):
+        return await flood(scope, receive, send)
+    if path.endswith('/wait-disconnect/'):
+        return await wait_disconnect(scope, receive, send)
+
+    h = hashlib.md5()
+    length = 0
+    while True:
+        message = await receive()
+        h.update(message['body'])
+        length += len(message['body'])
+        if not message['more_body']:
+            break
+
+    headers = [(b'content-type', b'text/plain')]
+    if path.endswith('/time/'):
+        body = '%.3f' % time.time()
+        headers.append((b'cache-control', b'max-age=60'))
+    elif path.endswith('/block/'):
+        body = 'ignored'
+        headers.append((b'x-wsgo-block', b'2'))
+    elif path.endswith('/disconnects/'):
+        body = str(disconnects)
+    else:
+        body = '|'.join([
+            scope['method'],
+            scope['http_version'],
+            scope['scheme'],
+            scope['root_path'],
+            scope['path'],
+            scope['query_string'].decode('latin-1'),
+            dict(scope['headers']).get(b'x-test', b'').decode('latin-1'),
+            scope['state'].get('greeting', ''),
+            '%d:%s' % (length, h.hexdigest()),
+        ])
+
+    await send({'type': 'http.response.start', 'status': 200, 'headers': headers})
+    await send({'type': 'http.response.body', 'body': body.encode('utf-8')})
+
+async def stream(scope, receive, send):
+    await send({
+        'type': 'http.response.start',
+        'status': 200,
+        'headers': [(b'content-type', b'text/plain')],
+    })
+    for i in range(3):
+        await send({'type': 'http.response.body', 'body': b'chunk%d ' % i, 'more_body': True})
+        await asyncio.sleep(0.1)
+    await send({'type': 'http.response.body'})
+
+async def flood(scope, receive, send):
+    # Keeps sending, however slowly the client reads
+    await send({'type': 'http.response.start', 'status': 200, 'headers': []})
+    while True:
+        await send({'type': 'http.response.body', 'body': b'x' * 1000000, 'more_body': True})
+
+async def wait_disconnect(scope, receive, send):
+    global disconnects
+    await send({'type': 'http.response.start', 'status': 200, 'headers': []})
+    await send({'type': 'http.response.body', 'body': b'waiting', 'more_body': True})
+    while (await receive())['type'] != 'http.disconnect':
+        pass
+    disconnects += 1
+
+async def lifespan(scope, receive, send):
+    while True:
+        message = await receive()
+        if message['type'] == 'lifespan.startup':
+            scope['state']['greeting'] = 'hello'
+            print('ASGI lifespan startup')
+            await send({'type': 'lifespan.startup.complete'})
+        elif message['type'] == 'lifespan.shutdown':
+            print('ASGI lifespan shutdown')
+            await send({'type': 'lifespan.shutdown.complete'})
+            return
+
+async def no_lifespan(scope, receive, send):
+    # Like many simple applications, doesn't handle lifespan events at all
+    assert scope['type'] == 'http'
+    await send({'type': 'http.response.start', 'status': 200, 'headers': []})
+    await send({'type': 'http.response.body', 'body': b'no lifespan'})
+
+async def failing_startup(scope, receive, send):
+    await receive()
+    await send({'type': 'lifespan.startup.failed', 'message': 'no database'})
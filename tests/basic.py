@@ -1,5 +1,7 @@
 from concurrent.futures import ThreadPoolExecutor
+import os
 import requests
+import socket
 import sys
 import time
 import unittest
@@ -184,3 +186,60 @@ class BasicTests(WsgoTestCase):
         # Check that the URL gets echoed back correctly
         r = requests.get('http://localhost:8000/echo/Božja')
         self.assertEqual(r.text, '/echo/Božja')
+
+    def test_multiple_listeners(self):
+        socket_path = '/tmp/wsgo-test.sock'
+        self.start(
+            '--module', 'wsgi_app', '--processes', '2',
+            '--http-socket', '127.0.0.1:8000',
+            '--http-socket', '127.0.0.1:8001',
+            '--http-socket', 'unix:' + socket_path,
+            '--socket-mode', '600',
+        )
+        time.sleep(1)
+
+        self.assertEqual(requests.get('http://localhost:8000/').status_code, 200)
+        self.assertEqual(requests.get('http://localhost:8001/').status_code, 200)
+
+        self.assertEqual(os.stat(socket_path).st_mode & 0o777, 0o600)
+        s = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        s.connect(socket_path)
+        s.sendall(b'GET / HTTP/1.0\r\nHost: localhost\r\n\r\n')
+        self.assertTrue(s.recv(1024).startswith(b'HTTP/1.0 200 OK'))
+        s.close()
+
+        self.stop()
+
+        # The manager should have removed the socket file on exit
+        self.assertFalse(os.path.exists(socket_path))
+
+    def test_shared_socket(self):
+        self.start('--module', 'wsgi_app', '--processes', '2', '--shared-socket')
+        time.sleep(1)
+
+        # Both processes should be accepting connections from the one socket
+        pids = set()
+        for i in range(50):
+            pids.add(requests.get('http://localhost:8000/pid/', headers={'Connection': 'close'}).text)
+        self.assertEqual(len(pids), 2)
+
+    def test_mounts(self):
+        self.start(
+            '--mount', '/api/=wsgi_app:paths',
+            '--mount', '/api/v2=wsgi_app:paths',
+            '--mount', '/=wsgi_app',
+        )
+        time.sleep(1)
+
+        # The longest matching prefix wins, and becomes the SCRIPT_NAME
+        self.assertEqual(requests.get('http://localhost:8000/api/users').text, '/api|/users')
+        self.assertEqual(requests.get('http://localhost:8000/api').text, '/api|')
+        self.assertEqual(requests.get('http://localhost:8000/api/v2/x').text, '/api/v2|/x')
+        self.assertEqual(requests.get('http://localhost:8000/apix').text, 'd41d8cd98f00b204e9800998ecf8427e')
+        self.stop()
+
+        # Without a root mount, anything else is not found
+        self.start('--mount', '/api=wsgi_app:paths')
+        time.sleep(1)
+        self.assertEqual(requests.get('http://localhost:8000/api/').text, '/api|/')
+        self.assertEqual(requests.get('http://localhost:8000/other').status_code, 404)
@@ -0,0 +1,145 @@
+import os
+import requests
+import signal
+import subprocess
+import sys
+import tempfile
+import time
+from .utils import WsgoTestCase
+
+class ConfigTests(WsgoTestCase):
+
+    def write_config(self, contents, suffix):
+        f = tempfile.NamedTemporaryFile('w', suffix=suffix, delete=False)
+        f.write(contents)
+        f.close()
+        self.addCleanup(os.unlink, f.name)
+        return f.name
+
+    def test_toml_config(self):
+        config = self.write_config(
+            '[wsgo]\n'
+            'module = "wsgi_app"\n'
+            'http-socket = "127.0.0.1:8000"\n'
+            'max_age = 60 # inline comment\n',
+            '.toml'
+        )
+        self.start('--config', config, '--process', '1')
+        t = requests.get('http://localhost:8000/time/').text
+        # Should have been cached, since max-age came from the config
+        self.assertEqual(requests.get('http://localhost:8000/time/').text, t)
+
+    def test_yaml_list(self):
+        config = self.write_config(
+            'module: wsgi_app\n'
+            'static-map:\n'
+            '  - /nothing=./nowhere\n'
+            '  - /static=.\n',
+            '.yaml'
+        )
+        self.start('--config', config, '--process', '1')
+        r = requests.get('http://localhost:8000/static/wsgi_app.py')
+        self.assertEqual(r.status_code, 200)
+        self.assertIn(b'def application', r.content)
+
+    def test_unknown_key(self):
+        config = self.write_config('workers = 4\nbogus = 1\n', '.ini')
+        p = subprocess.run(
+            ['wsgo', '--config', config],
+            cwd=os.path.dirname(__file__),
+            stdout=subprocess.PIPE, stderr=subprocess.PIPE,
+        )
+        self.assertEqual(p.returncode, 27)
+        self.assertIn(b"unknown option 'bogus'", p.stderr)
+
+    def test_environment(self):
+        config = self.write_config('max-age = 60\n', '.toml')
+        self.start('--process', '1', env={
+            'WSGO_CONFIG': config,
+            'WSGO_MODULE': 'wsgi_app',
+            'WSGO_MAX_AGE': '0',
+            'WSGO_STATIC_MAP': '/nothing=./nowhere\n /static=.\n',
+        })
+        r = requests.get('http://localhost:8000/static/wsgi_app.py')
+        self.assertEqual(r.status_code, 200)
+
+        # The config file should have taken precedence over the environment
+        t = requests.get('http://localhost:8000/time/').text
+        self.assertEqual(requests.get('http://localhost:8000/time/').text, t)
+
+    def test_config_changed_before_restart(self):
+        config = self.write_config('module = "wsgi_app"\n', '.toml')
+        self.start(env={'WSGO_CONFIG': config})
+        time.sleep(1)
+
+        # Processes started by a rolling restart keep the process manager's
+        # options, rather than reading the changed config file themselves
+        with open(config, 'a') as f:
+            f.write('max-age = 60\n')
+        self.process.send_signal(signal.SIGHUP)
+        time.sleep(3)
+        t = requests.get('http://localhost:8000/time/').text
+        self.assertNotEqual(requests.get('http://localhost:8000/time/').text, t)
+
+    def test_environment_list(self):
+        # Repeatable options take a value per line, which may contain commas
+        self.start(env={
+            'WSGO_MODULE': 'wsgi_app',
+            'WSGO_ENV': 'WSGO_TEST_LIST=a,b\nWSGO_TEST_VAR=hello',
+        })
+        time.sleep(1)
+
+        self.assertEqual(requests.get('http://localhost:8000/getenv/WSGO_TEST_LIST').text, 'a,b')
+        self.assertEqual(requests.get('http://localhost:8000/getenv/WSGO_TEST_VAR').text, 'hello')
+
+    def test_application_spec(self):
+        self.start('--module', 'wsgi_app:paths')
+        time.sleep(1)
+        self.assertEqual(requests.get('http://localhost:8000/x').text, '|/x')
+        self.stop()
+
+        # A factory with literal arguments, importable from anywhere
+        self.start(
+            '--module', "wsgi_app:make_app(greeting='hi')",
+            '--chdir', '/tmp',
+            '--pythonpath', os.path.dirname(os.path.abspath(__file__)),
+        )
+        time.sleep(1)
+        self.assertEqual(requests.get('http://localhost:8000/').text, 'hi from /tmp')
+        self.stop()
+
+        # Arbitrary expressions aren't evaluated
+        p = subprocess.run(
+            ['wsgo', '--module', 'wsgi_app:make_app(greeting=open("x"))', '--process', '1'],
+            cwd=os.path.dirname(__file__),
+            stdout=subprocess.PIPE, stderr=subprocess.PIPE,
+        )
+        self.assertEqual(p.returncode, 27)
+
+    def test_virtualenv(self):
+        with tempfile.TemporaryDirectory() as venv:
+            subprocess.run([sys.executable, '-m', 'venv', '--without-pip', venv], check=True)
+            self.start('--module', 'wsgi_app', '--virtualenv', venv)
+            time.sleep(1)
+            self.assertEqual(requests.get('http://localhost:8000/sys-prefix/').text, venv)
+            self.stop()
+
+            # Packages installed in the virtualenv can be imported
+            site_packages = os.path.join(venv, 'lib', 'python%d.%d' % sys.version_info[:2], 'site-packages')
+            with open(os.path.join(site_packages, 'venv_app.py'), 'w') as f:
+                f.write('def application(environ, start_response):\n'
+                    '    start_response("200 OK", [])\n'
+                    '    return [b"from the virtualenv"]\n')
+            self.start('--module', 'venv_app', '--virtualenv', venv)
+            time.sleep(1)
+            self.assertEqual(requests.get('http://localhost:8000/').text, 'from the virtualenv')
+            self.stop()
+
+            # Not a virtualenv after all
+            os.unlink(os.path.join(venv, 'pyvenv.cfg'))
+            p = subprocess.run(
+                ['wsgo', '--module', 'wsgi_app', '--virtualenv', venv, '--process', '1'],
+                cwd=os.path.dirname(__file__),
+                stdout=subprocess.PIPE, stderr=subprocess.PIPE,
+            )
+            self.assertEqual(p.returncode, 27)
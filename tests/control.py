@@ -0,0 +1,57 @@
+import json
+import os
+import requests
+import subprocess
+import tempfile
+import time
+from .utils import WsgoTestCase
+
+class ControlTests(WsgoTestCase):
+
+    def setUp(self):
+        super().setUp()
+        self.socket_path = os.path.join(tempfile.mkdtemp(), 'control.sock')
+
+    def ctl(self, *args):
+        out = subprocess.run(
+            ['wsgo', 'ctl', '--control-socket', self.socket_path] + list(args),
+            stdout=subprocess.PIPE, timeout=20,
+        )
+        return out.returncode, json.loads(out.stdout)
+
+    def test_status(self):
+        self.start('--module', 'wsgi_app', '--processes', '2', '--control-socket', self.socket_path)
+        time.sleep(1)
+
+        # Only the user wsgo runs as can connect
+        self.assertEqual(os.stat(self.socket_path).st_mode & 0o777, 0o600)
+
+        code, status = self.ctl('status')
+        self.assertEqual(code, 0)
+        self.assertEqual(status['manager']['processes'], [1, 2])
+        self.assertEqual(set(status['processes']), {'1', '2'})
+        self.assertEqual(len(status['processes']['1']['workers']), 16)
+
+        code, result = self.ctl('frobnicate')
+        self.assertEqual(code, 1)
+        self.assertIn('error', result)
+
+    def test_cache_purge(self):
+        self.start('--module', 'wsgi_app', '--max-age', '60', '--control-socket', self.socket_path)
+        time.sleep(1)
+
+        t = requests.get('http://localhost:8000/time/?cache').text
+        self.assertEqual(requests.get('http://localhost:8000/time/?cache').text, t)
+
+        code, result = self.ctl('cache', 'purge', '/time/')
+        self.assertEqual(result['processes']['1']['purged'], 1)
+        self.assertNotEqual(requests.get('http://localhost:8000/time/?cache').text, t)
+
+    def test_stop(self):
+        self.start('--module', 'wsgi_app', '--control-socket', self.socket_path)
+        time.sleep(1)
+
+        code, result = self.ctl('stop')
+        self.assertEqual(code, 0)
+        self.assertEqual(self.process.wait(timeout=10), 0)
+        self.assertFalse(os.path.exists(self.socket_path))
@@ -0,0 +1,30 @@
+import os
+import requests
+import subprocess
+import time
+from .utils import WsgoTestCase
+
+class CpuAffinityTests(WsgoTestCase):
+
+    def test_invalid_policy(self):
+        for policy in ['sometimes', 'list:0-2000000000']:
+            p = subprocess.run(
+                ['wsgo', '--module', 'wsgi_app', '--cpu-affinity', policy],
+                cwd=os.path.dirname(__file__),
+                stdout=subprocess.PIPE, stderr=subprocess.PIPE,
+            )
+            self.assertEqual(p.returncode, 27, policy)
+
+    def test_list(self):
+        # The first allowed CPU
+        cpu = min(os.sched_getaffinity(0))
+        self.start('--module', 'wsgi_app', '--cpu-affinity', 'list:%d' % cpu)
+        time.sleep(1)
+        pid = requests.get('http://localhost:8000/pid/').text
+
+        # Some threads (the workers) should have been pinned
+        pinned = 0
+        for task in os.listdir('/proc/%s/task' % pid):
+            if os.sched_getaffinity(int(task)) == {cpu}:
+                pinned += 1
+        self.assertGreaterEqual(pinned, 16)
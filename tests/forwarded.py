@@ -0,0 +1,54 @@
+import requests
+import time
+from .utils import WsgoTestCase
+
+class ForwardedTests(WsgoTestCase):
+
+    def get(self, path, **headers):
+        return requests.get('http://localhost:8000' + path, headers=headers)
+
+    def test_scheme(self):
+        # Loopback and private addresses are trusted by default
+        self.start('--module', 'wsgi_app', '--process', '1')
+        time.sleep(1)
+
+        self.assertEqual(self.get('/scheme/').text, 'http')
+        self.assertEqual(self.get('/scheme/', **{'X-Forwarded-Proto': 'https'}).text, 'https')
+        self.assertEqual(self.get('/scheme/', Forwarded='for=203.0.113.7;proto=https').text, 'https')
+        # Forwarded takes precedence over the X-Forwarded-* headers
+        self.assertEqual(self.get('/scheme/', **{
+            'Forwarded': 'for=203.0.113.7;proto=http',
+            'X-Forwarded-Proto': 'https',
+        }).text, 'http')
+        # Anything else is ignored
+        self.assertEqual(self.get('/scheme/', **{'X-Forwarded-Proto': 'gopher'}).text, 'http')
+        self.stop()
+
+        # Otherwise only the given proxies are trusted
+        self.start('--module', 'wsgi_app', '--process', '1', '--trusted-proxy', '10.0.0.0/8')
+        time.sleep(1)
+
+        self.assertEqual(self.get('/scheme/', **{'X-Forwarded-Proto': 'https'}).text, 'http')
+        self.assertEqual(self.get('/scheme/', Forwarded='proto=https').text, 'http')
+
+    def test_client_address(self):
+        """
+        Blocks a client identified by walking its X-Forwarded-For header from
+        right to left, past the trusted proxies.
+        """
+
+        self.start(
+            '--module', 'wsgi_app', '--process', '1',
+            '--trusted-proxy', '127.0.0.1', '--trusted-proxy', '10.0.0.0/8',
+        )
+        time.sleep(1)
+
+        # The client spoofed the first address, and went through two proxies
+        r = self.get('/block/', **{'X-Forwarded-For': '198.51.100.1, 203.0.113.7, 10.1.2.3'})
+        self.assertEqual(r.status_code, 200)
+
+        # So the spoofed address isn't blocked, but the real one is
+        self.assertEqual(self.get('/', **{'X-Forwarded-For': '198.51.100.1'}).status_code, 200)
+        self.assertEqual(self.get('/', **{'X-Forwarded-For': '203.0.113.7, 198.51.100.2'}).status_code, 200)
+        self.assertEqual(self.get('/', Forwarded='for="[2001:db8::1]:4711"').status_code, 200)
+        self.assertEqual(self.get('/', Forwarded='for=203.0.113.7;proto=https, for=10.0.0.1').status_code, 429)
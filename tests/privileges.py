@@ -0,0 +1,34 @@
+import os
+import pwd
+import requests
+import sys
+import time
+import unittest
+from .utils import WsgoTestCase
+
+def readable_by_others(path):
+    # Every directory on the way to path must be searchable by other users
+    path = os.path.abspath(path)
+    while path != '/':
+        if not os.stat(path).st_mode & 0o001:
+            return False
+        path = os.path.dirname(path)
+    return True
+
+class PrivilegeTests(WsgoTestCase):
+
+    @unittest.skipUnless(os.geteuid() == 0, 'needs to be run as root')
+    @unittest.skipUnless(
+        readable_by_others(os.path.dirname(__file__)) and readable_by_others(sys.base_prefix),
+        'tests and Python must be readable by other users')
+    def test_drop_privileges(self):
+        self.start('--module', 'wsgi_app', '--uid', 'nobody', '--http-socket', '127.0.0.1:80')
+        time.sleep(1)
+        r = requests.get('http://localhost:80/uid/')
+        nobody = pwd.getpwnam('nobody')
+        self.assertEqual(r.text, '%d:%d' % (nobody.pw_uid, nobody.pw_gid))
+
+    def test_unknown_user(self):
+        self.start('--module', 'wsgi_app', '--uid', 'no-such-user')
+        # Startup should fail rather than running as the wrong user
+        self.assertEqual(self.process.wait(timeout=10), 29)
@@ -0,0 +1,294 @@
+import os
+import requests
+import shutil
+import signal
+import tempfile
+import threading
+import time
+from .utils import WsgoTestCase
+
+class ProcessManagerTests(WsgoTestCase):
+
+    def is_running(self, pid):
+        try:
+            with open('/proc/%d/stat' % pid) as f:
+                state = f.read().rsplit(') ', 1)[1].split()[0]
+        except FileNotFoundError:
+            return False
+        # (a killed process may linger as a zombie until it is reaped)
+        return state != 'Z'
+
+    def get_pids(self, n=20):
+        return set(requests.get('http://localhost:8000/pid/').text for i in range(n))
+
+    def test_rolling_restart(self):
+        self.start('--module', 'wsgi_app', '--processes', '2')
+        time.sleep(1)
+        old_pids = self.get_pids()
+
+        failures = []
+        stop = threading.Event()
+        def hammer():
+            while not stop.is_set():
+                try:
+                    requests.get('http://localhost:8000/pid/', timeout=5)
+                except requests.exceptions.RequestException as e:
+                    failures.append(e)
+        thread = threading.Thread(target=hammer)
+        thread.start()
+
+        self.process.send_signal(signal.SIGHUP)
+        time.sleep(3)
+
+        stop.set()
+        thread.join()
+
+        # No requests should have failed during the restart
+        self.assertEqual(failures, [])
+
+        # And every process should have been replaced
+        new_pids = self.get_pids()
+        self.assertEqual(len(new_pids), 2)
+        self.assertFalse(old_pids & new_pids)
+
+    def get_listening_sockets(self, pid):
+        """
+        Returns the inodes of the sockets listening on port 8000 in a process.
+        """
+        listening = set()
+        for name in ('tcp', 'tcp6'):
+            with open('/proc/net/' + name) as f:
+                for line in f.readlines()[1:]:
+                    fields = line.split()
+                    if fields[1].endswith(':1F40') and fields[3] == '0A':
+                        listening.add(fields[9])
+        fds = set()
+        for fd in os.listdir('/proc/%s/fd' % pid):
+            try:
+                fds.add(os.readlink('/proc/%s/fd/%s' % (pid, fd)))
+            except FileNotFoundError:
+                pass
+        return {i for i in listening if 'socket:[%s]' % i in fds}
+
+    def test_rolling_restart_queued_connections(self):
+        """
+        Connections queued on a process's socket when it is replaced should be
+        handled by the replacement, rather than reset, so the replacement takes
+        over the same socket.
+        """
+        self.start('--module', 'wsgi_app', '--processes', '2')
+        time.sleep(1)
+
+        old_pids = self.get_pids()
+        old_sockets = [self.get_listening_sockets(pid) for pid in old_pids]
+        self.assertEqual([len(s) for s in old_sockets], [1, 1])
+        # (each process has its own)
+        self.assertNotEqual(old_sockets[0], old_sockets[1])
+
+        self.process.send_signal(signal.SIGHUP)
+        time.sleep(3)
+        new_pids = self.get_pids()
+        self.assertFalse(old_pids & new_pids)
+        new_sockets = [self.get_listening_sockets(pid) for pid in new_pids]
+        self.assertEqual(sorted(map(sorted, new_sockets)), sorted(map(sorted, old_sockets)))
+
+        failures = []
+        count = [0]
+        stop = threading.Event()
+        def hammer():
+            while not stop.is_set():
+                try:
+                    # (a new connection each time)
+                    requests.get('http://localhost:8000/pid/', timeout=5)
+                    count[0] += 1
+                except requests.exceptions.RequestException as e:
+                    failures.append(e)
+        threads = [threading.Thread(target=hammer) for i in range(16)]
+        for thread in threads:
+            thread.start()
+
+        for i in range(3):
+            self.process.send_signal(signal.SIGHUP)
+            time.sleep(2.5)
+
+        stop.set()
+        for thread in threads:
+            thread.join()
+
+        self.assertEqual(failures, [])
+        self.assertGreater(count[0], 100)
+
+    def test_autoreload(self):
+        app_dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, app_dir)
+        app_file = os.path.join(app_dir, 'autoreload_app.py')
+
+        def write_app(contents):
+            with open(app_file, 'w') as f:
+                f.write(contents)
+
+        write_app(
+            'def application(environ, start_response):\n'
+            '    start_response("200 OK", [])\n'
+            '    return [b"one"]\n'
+        )
+        self.start('--module', 'autoreload_app', '--py-autoreload', env={
+            'PYTHONPATH': app_dir,
+        })
+        time.sleep(1)
+        self.assertEqual(requests.get('http://localhost:8000/').text, 'one')
+
+        # A half-saved file shouldn't cause the process to exit
+        write_app('def application(environ, start_response:\n')
+        time.sleep(3)
+        self.assertIsNone(self.process.poll())
+
+        write_app(
+            'def application(environ, start_response):\n'
+            '    start_response("200 OK", [])\n'
+            '    return [b"two"]\n'
+        )
+        time.sleep(4)
+        self.assertEqual(requests.get('http://localhost:8000/').text, 'two')
+
+    def test_autoreload_missing_module(self):
+        # Nothing can be imported, but the module appearing should be noticed
+        app_dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, app_dir)
+        self.start('--module', 'missing_app', '--py-autoreload', '--pythonpath', app_dir)
+        time.sleep(2)
+        self.assertIsNone(self.process.poll())
+
+        with open(os.path.join(app_dir, 'missing_app.py'), 'w') as f:
+            f.write(
+                'def application(environ, start_response):\n'
+                '    start_response("200 OK", [])\n'
+                '    return [b"found"]\n'
+            )
+        time.sleep(4)
+        self.assertEqual(requests.get('http://localhost:8000/').text, 'found')
+
+    def test_max_requests(self):
+        self.start('--module', 'wsgi_app', '--max-requests', '20', '--recycle-jitter', '0')
+        time.sleep(1)
+
+        pids = set()
+        for i in range(60):
+            r = requests.get('http://localhost:8000/pid/', timeout=5)
+            self.assertEqual(r.status_code, 200)
+            pids.add(r.text)
+            time.sleep(0.05)
+
+        # The process should have been replaced at least once, without any
+        # requests failing
+        self.assertGreater(len(pids), 1)
+
+    def test_hang_detection(self):
+        self.start('--module', 'wsgi_app', '--heartbeat-timeout', '2')
+        time.sleep(1)
+        old_pid = requests.get('http://localhost:8000/pid/').text
+
+        # Freeze the process so that it stops heartbeating
+        os.kill(int(old_pid), signal.SIGSTOP)
+        time.sleep(5)
+
+        new_pid = requests.get('http://localhost:8000/pid/', timeout=5).text
+        self.assertNotEqual(old_pid, new_pid)
+
+    def test_crash_limit(self):
+        app_dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, app_dir)
+        with open(os.path.join(app_dir, 'crash_app.py'), 'w') as f:
+            f.write('import os\nos._exit(3)\n')
+
+        self.start('--module', 'crash_app', '--crash-limit', '3', env={
+            'PYTHONPATH': app_dir,
+        })
+
+        # The process manager should give up after the fourth crash
+        self.assertEqual(self.process.wait(timeout=10), 1)
+
+    def test_invalid_application(self):
+        self.start('--module', 'wsgi_app:make_app(greeting=open("x"))', '--processes', '2')
+
+        # Processes that can't load the application aren't restarted, and the
+        # process manager exits with an error once they have all given up
+        self.assertEqual(self.process.wait(timeout=10), 27)
+
+    def test_manual_scaling(self):
+        self.start('--module', 'wsgi_app')
+        time.sleep(1)
+        self.assertEqual(len(self.get_pids()), 1)
+        self.assertEqual(requests.get('http://localhost:8000/environ/wsgi.multiprocess').text, 'False')
+
+        self.process.send_signal(signal.SIGTTIN)
+        time.sleep(2)
+        self.assertEqual(len(self.get_pids(50)), 2)
+        # Both the new process and the existing one should know there are now
+        # several
+        self.assertEqual(
+            set(requests.get('http://localhost:8000/environ/wsgi.multiprocess').text for i in range(50)),
+            {'True'},
+        )
+
+        self.process.send_signal(signal.SIGTTOU)
+        time.sleep(2)
+        self.assertEqual(len(self.get_pids()), 1)
+
+    def test_load_scaling(self):
+        self.start('--module', 'wsgi_app', '--workers', '2',
+            '--min-processes', '1', '--max-processes', '2')
+        time.sleep(1)
+        self.assertEqual(len(self.get_pids()), 1)
+
+        # Keep both workers busy until another process is started
+        stop = threading.Event()
+        def hammer():
+            while not stop.is_set():
+                requests.get('http://localhost:8000/wait/', timeout=10)
+        threads = [threading.Thread(target=hammer) for i in range(4)]
+        for thread in threads:
+            thread.start()
+        time.sleep(9)
+        stop.set()
+        for thread in threads:
+            thread.join()
+
+        self.assertEqual(len(self.get_pids(50)), 2)
+
+    def test_environment_and_limits(self):
+        self.start('--module', 'wsgi_app',
+            '--env', 'WSGO_TEST_VAR=hello', '--unset-env', 'WSGO_TEST_UNSET',
+            '--limit-nofile', '500', '--limit-core', '0',
+            env={'WSGO_TEST_UNSET': 'still here'})
+        time.sleep(1)
+
+        self.assertEqual(requests.get('http://localhost:8000/getenv/WSGO_TEST_VAR').text, 'hello')
+        self.assertEqual(requests.get('http://localhost:8000/getenv/WSGO_TEST_UNSET').text, 'None')
+        self.assertEqual(requests.get('http://localhost:8000/rlimit-nofile/').text, '500')
+
+        # The limits apply to the whole process, not just the Python threads
+        pid = requests.get('http://localhost:8000/pid/').text
+        with open('/proc/%s/limits' % pid) as f:
+            limits = {line[:26].strip(): line[26:].split()[:2] for line in f}
+        self.assertEqual(limits['Max open files'], ['500', '500'])
+        self.assertEqual(limits['Max core file size'], ['0', '0'])
+
+    def test_invalid_limit(self):
+        self.start('--module', 'wsgi_app', '--limit-nofile', '99999999999')
+
+        # The process can't set the limit, so isn't restarted
+        self.assertEqual(self.process.wait(timeout=10), 27)
+
+    def test_process_group(self):
+        self.start('--module', 'wsgi_app', '--process-group')
+        time.sleep(1)
+
+        pid = int(requests.get('http://localhost:8000/pid/').text)
+        spawned = int(requests.get('http://localhost:8000/spawn/').text)
+
+        # Killing the process should also kill its subprocess, once the
+        # process manager notices
+        os.kill(pid, signal.SIGKILL)
+        time.sleep(1)
+        self.assertFalse(self.is_running(spawned))
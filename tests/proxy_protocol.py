@@ -0,0 +1,106 @@
+import os
+import socket
+import struct
+import subprocess
+import time
+from .utils import WsgoTestCase
+
+V2_SIGNATURE = b'\r\n\r\n\x00\r\nQUIT\n'
+
+def request(header, path):
+    """
+    Sends a GET request preceded by a PROXY protocol header, returning the
+    status code and body (or None if the connection was dropped).
+    """
+    s = socket.create_connection(('127.0.0.1', 8000))
+    s.sendall(header + b'GET ' + path + b' HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n')
+    response = b''
+    while True:
+        data = s.recv(65536)
+        if not data:
+            break
+        response += data
+    s.close()
+    if not response:
+        return None
+    head, _, body = response.partition(b'\r\n\r\n')
+    return int(head.split(b' ')[1]), body
+
+def v1(address, port=51234):
+    return b'PROXY TCP4 %s 127.0.0.1 %d 8000\r\n' % (address, port)
+
+def v2(address, port=51234, command=0x21, tlvs=b''):
+    payload = socket.inet_aton(address) + socket.inet_aton('127.0.0.1') + struct.pack('!HH', port, 8000) + tlvs
+    return V2_SIGNATURE + bytes([command, 0x11]) + struct.pack('!H', len(payload)) + payload
+
+class ProxyProtocolTests(WsgoTestCase):
+
+    def test_addresses(self):
+        self.start(
+            '--module', 'wsgi_app', '--process', '1',
+            '--http-socket', '127.0.0.1:8000', '--proxy-protocol', '127.0.0.1:8000',
+        )
+        time.sleep(1)
+
+        self.assertEqual(request(v1(b'203.0.113.7'), b'/remote-addr/'), (200, b'203.0.113.7'))
+        self.assertEqual(
+            request(b'PROXY TCP6 2001:db8::1 ::1 51234 8000\r\n', b'/remote-addr/'),
+            (200, b'2001:db8::1'),
+        )
+        self.assertEqual(request(v2('198.51.100.9', tlvs=b'\x04\x00\x01x'), b'/remote-addr/'), (200, b'198.51.100.9'))
+
+        # Health checks from the load balancer itself keep the real address
+        self.assertEqual(request(b'PROXY UNKNOWN\r\n', b'/remote-addr/'), (200, b'127.0.0.1'))
+        self.assertEqual(request(v2('198.51.100.9', command=0x20), b'/remote-addr/'), (200, b'127.0.0.1'))
+
+        # Connections without a valid header are dropped
+        self.assertIsNone(request(b'', b'/remote-addr/'))
+        self.assertIsNone(request(b'PROXY TCP4 nonsense\r\n', b'/remote-addr/'))
+
+    def test_slow_headers(self):
+        self.start(
+            '--module', 'wsgi_app', '--process', '1',
+            '--http-socket', '127.0.0.1:8000', '--proxy-protocol', '127.0.0.1:8000',
+        )
+        time.sleep(1)
+
+        # The request headers still have to arrive in time after the PROXY
+        # header, rather than trickling in forever
+        s = socket.create_connection(('127.0.0.1', 8000))
+        s.sendall(v1(b'203.0.113.7') + b'GET / HTTP/1.1\r\n')
+        start = time.time()
+        closed = False
+        for i in range(20):
+            try:
+                s.sendall(b'X-Slow-%d: 1\r\n' % i)
+            except (BrokenPipeError, ConnectionResetError):
+                closed = True
+                break
+            time.sleep(0.5)
+        s.close()
+        self.assertTrue(closed)
+        self.assertLess(time.time() - start, 5)
+
+    def test_block(self):
+        self.start(
+            '--module', 'wsgi_app', '--process', '1',
+            '--http-socket', '127.0.0.1:8000', '--proxy-protocol', '127.0.0.1:8000',
+        )
+        time.sleep(1)
+
+        self.assertEqual(request(v1(b'203.0.113.7'), b'/block/')[0], 200)
+
+        # Only the client behind the load balancer is blocked
+        self.assertEqual(request(v1(b'203.0.113.8'), b'/')[0], 200)
+        start = time.time()
+        self.assertEqual(request(v1(b'203.0.113.7', port=51235), b'/')[0], 429)
+        self.assertGreater(time.time() - start, 1)
+
+    def test_unknown_address(self):
+        p = subprocess.run(
+            ['wsgo', '--http-socket', '127.0.0.1:8000', '--proxy-protocol', '127.0.0.1:9000'],
+            cwd=os.path.dirname(__file__),
+            stdout=subprocess.PIPE, stderr=subprocess.PIPE,
+        )
+        self.assertEqual(p.returncode, 27)
+        self.assertIn(b"isn't one of the listening addresses", p.stderr)
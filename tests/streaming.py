@@ -0,0 +1,92 @@
+import requests
+import time
+from .utils import WsgoTestCase
+
+class StreamingTests(WsgoTestCase):
+
+    def read_events(self, url):
+        """
+        Returns a list of (seconds since the request, event) as they arrive.
+        """
+        start = time.time()
+        r = requests.get(url, stream=True, timeout=10)
+        events = []
+        try:
+            for line in r.iter_lines(chunk_size=1):
+                if line:
+                    events.append((time.time() - start, line.decode('utf-8')))
+        except requests.exceptions.ChunkedEncodingError:
+            # Cut short
+            pass
+        return events
+
+    def test_flush(self):
+        self.start('--module', 'wsgi_app', '--process', '1')
+        time.sleep(1)
+
+        for query in ('', '?accel'):
+            events = self.read_events('http://localhost:8000/stream/3/1/' + query)
+            self.assertEqual([e for t, e in events], ['data: 0', 'data: 1', 'data: 2'])
+            # Each event arrives as it is sent
+            self.assertLess(events[0][0], 0.8)
+            self.assertLess(events[1][0], 1.8)
+
+        # Unless the response didn't ask to be streamed, whether or not it has
+        # a length
+        for query in ('?length', '?plain'):
+            events = self.read_events('http://localhost:8000/stream/3/1/' + query)
+            self.assertEqual([e for t, e in events], ['data: 0', 'data: 1', 'data: 2'])
+            self.assertGreater(events[0][0], 1.8)
+
+    def test_not_cached(self):
+        self.start('--module', 'wsgi_app', '--process', '1', '--max-age', '60')
+        time.sleep(1)
+
+        # Each request gets its own stream, rather than a cached copy
+        for _ in range(2):
+            events = self.read_events('http://localhost:8000/stream/2/1/?cached')
+            self.assertEqual([e for t, e in events], ['data: 0', 'data: 1'])
+            self.assertGreater(events[1][0], 0.8)
+
+    def test_timeout(self):
+        self.start(
+            '--module', 'wsgi_app', '--process', '1',
+            '--request-timeout', '1', '--streaming-timeout', '3',
+        )
+        time.sleep(1)
+
+        # Streamed responses can outlast the request timeout
+        events = self.read_events('http://localhost:8000/stream/3/1/')
+        self.assertEqual(len(events), 3)
+
+        # But not the streaming timeout
+        events = self.read_events('http://localhost:8000/stream/10/1/')
+        self.assertIn(len(events), (3, 4))
+
+        # While other responses still get interrupted
+        r = requests.get('http://localhost:8000/wait10/')
+        self.assertEqual(r.status_code, 502)
+
+    def test_short_streaming_timeout(self):
+        self.start(
+            '--module', 'wsgi_app', '--process', '1',
+            '--request-timeout', '10', '--streaming-timeout', '2',
+        )
+        time.sleep(1)
+
+        # A streaming timeout shorter than the request timeout still applies
+        start = time.time()
+        events = self.read_events('http://localhost:8000/stream/10/1/')
+        self.assertIn(len(events), (2, 3))
+        self.assertLess(time.time() - start, 5)
+
+    def test_shutdown(self):
+        self.start('--module', 'wsgi_app', '--process', '1')
+        time.sleep(1)
+
+        events = self.pool.submit(self.read_events, 'http://localhost:8000/stream/100/0.1/')
+        time.sleep(1)
+        start = time.time()
+        self.stop()
+        self.assertLess(time.time() - start, 5)
+        self.assertLess(len(events.result()), 50)
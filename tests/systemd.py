@@ -0,0 +1,62 @@
+import os
+import requests
+import socket
+import tempfile
+import time
+from .utils import WsgoTestCase
+
+class SystemdTests(WsgoTestCase):
+
+    def test_notify(self):
+        notify_dir = tempfile.mkdtemp()
+        notify_path = os.path.join(notify_dir, 'notify.sock')
+        notify = socket.socket(socket.AF_UNIX, socket.SOCK_DGRAM)
+        notify.bind(notify_path)
+        notify.settimeout(10)
+        self.addCleanup(os.rmdir, notify_dir)
+        self.addCleanup(os.unlink, notify_path)
+        self.addCleanup(notify.close)
+
+        self.start('--module', 'wsgi_app', '--processes', '2', env={
+            'NOTIFY_SOCKET': notify_path,
+            'WATCHDOG_USEC': '1000000',
+        })
+
+        messages = []
+        deadline = time.time() + 10
+        while time.time() < deadline and not (
+                'READY=1' in messages and 'WATCHDOG=1' in messages
+                and any(m.startswith('STATUS=') for m in messages)):
+            messages.append(notify.recv(4096).decode())
+
+        self.assertIn('READY=1', messages)
+        self.assertIn('WATCHDOG=1', messages)
+        self.assertTrue(any(m.startswith('STATUS=2 processes') for m in messages))
+
+        # Both processes should be serving by the time we're told it's ready
+        r = requests.get('http://localhost:8000')
+        self.assertEqual(r.status_code, 200)
+
+    def test_socket_activation(self):
+        listener = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        listener.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+        listener.bind(('127.0.0.1', 8001))
+        listener.listen(10)
+        self.addCleanup(listener.close)
+
+        def pass_socket():
+            # Runs in the child, so we know the pid that wsgo will have
+            os.dup2(listener.fileno(), 3)
+            os.environ['LISTEN_PID'] = str(os.getpid())
+            os.environ['LISTEN_FDS'] = '1'
+            os.environ['LISTEN_FDNAMES'] = 'http'
+
+        self.start('--module', 'wsgi_app', preexec_fn=pass_socket, pass_fds=(3,))
+        time.sleep(1)
+
+        r = requests.get('http://localhost:8001')
+        self.assertEqual(r.status_code, 200)
+
+        # It shouldn't have bound the default address as well
+        with self.assertRaises(requests.exceptions.ConnectionError):
+            requests.get('http://localhost:8000')
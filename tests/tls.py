@@ -0,0 +1,182 @@
+import json
+import os
+import requests
+import shutil
+import ssl
+import socket
+import subprocess
+import tempfile
+import time
+from .utils import WsgoTestCase
+
+# Self-signed certificates are generated for each run, into here
+CERTS = None
+
+def generate_certificate(name):
+    subprocess.run([
+        'openssl', 'req', '-x509', '-newkey', 'rsa:2048', '-nodes', '-days', '1',
+        '-subj', '/CN=' + name, '-addext', 'subjectAltName=DNS:' + name,
+        '-keyout', os.path.join(CERTS, name + '.key'),
+        '-out', os.path.join(CERTS, name + '.crt'),
+    ], check=True, stdout=subprocess.PIPE, stderr=subprocess.PIPE)
+
+def http2_get(sock, scheme, path):
+    # Just enough HTTP/2 to make one GET request and read the response body,
+    # so the test doesn't depend on an HTTP/2-capable client being installed
+    def frame(type, flags, stream, payload=b''):
+        return len(payload).to_bytes(3, 'big') + bytes([type, flags]) + stream.to_bytes(4, 'big') + payload
+
+    # :method GET, :scheme, then :path and :authority as literals (HPACK)
+    headers = bytes([0x82, 0x86 if scheme == 'http' else 0x87])
+    headers += bytes([0x04, len(path)]) + path.encode()
+    headers += bytes([0x01, len('localhost')]) + b'localhost'
+    sock.sendall(
+        b'PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n'
+        + frame(4, 0, 0)
+        + frame(1, 0x5, 1, headers) # END_STREAM | END_HEADERS
+    )
+
+    f = sock.makefile('rb')
+    body = b''
+    while True:
+        header = f.read(9)
+        if len(header) < 9:
+            raise EOFError('connection closed before the response ended')
+        length = int.from_bytes(header[:3], 'big')
+        type, flags = header[3], header[4]
+        stream = int.from_bytes(header[5:], 'big') & 0x7fffffff
+        payload = f.read(length)
+        if type == 4 and not flags & 0x1:
+            sock.sendall(frame(4, 0x1, 0)) # acknowledge SETTINGS
+        if stream != 1:
+            continue
+        if type == 0:
+            body += payload
+        if type in (0, 1) and flags & 0x1:
+            return body
+
+class TLSTests(WsgoTestCase):
+
+    @classmethod
+    def setUpClass(cls):
+        global CERTS
+        CERTS = tempfile.mkdtemp()
+        for name in ('localhost', 'other.test'):
+            generate_certificate(name)
+
+    @classmethod
+    def tearDownClass(cls):
+        shutil.rmtree(CERTS)
+
+    def start_tls(self, *args):
+        if '--processes' not in args:
+            args += ('--process', '1')
+        self.start(*args,
+            '--module', 'wsgi_app',
+            '--http-socket', '127.0.0.1:8000',
+            '--https-socket', '127.0.0.1:8443',
+            '--tls-cert', os.path.join(CERTS, 'localhost.crt'),
+            '--tls-key', os.path.join(CERTS, 'localhost.key'),
+            '--tls-cert', os.path.join(CERTS, 'other.test.crt'),
+            '--tls-key', os.path.join(CERTS, 'other.test.key'),
+        )
+
+    def get_alpn_protocol(self):
+        context = ssl.create_default_context()
+        context.check_hostname = False
+        context.verify_mode = ssl.CERT_NONE
+        context.set_alpn_protocols(['h2', 'http/1.1'])
+        with socket.create_connection(('127.0.0.1', 8443)) as s:
+            with context.wrap_socket(s, server_hostname='localhost') as ss:
+                return ss.selected_alpn_protocol()
+
+    def get_certificate_name(self, server_name):
+        context = ssl.create_default_context()
+        context.check_hostname = False
+        context.verify_mode = ssl.CERT_NONE
+        with socket.create_connection(('127.0.0.1', 8443)) as s:
+            with context.wrap_socket(s, server_hostname=server_name) as ss:
+                cert = ssl.DER_cert_to_PEM_cert(ss.getpeercert(binary_form=True))
+        for name in ('localhost', 'other.test'):
+            with open(os.path.join(CERTS, name + '.crt')) as f:
+                if f.read().strip() == cert.strip():
+                    return name
+
+    def test_https(self):
+        self.start_tls()
+        r = requests.get(
+            'https://localhost:8443/environ/wsgi.url_scheme',
+            verify=os.path.join(CERTS, 'localhost.crt'),
+        )
+        self.assertEqual(r.text, 'https')
+        r = requests.get(
+            'https://localhost:8443/environ/HTTPS',
+            verify=os.path.join(CERTS, 'localhost.crt'),
+        )
+        self.assertEqual(r.text, 'on')
+
+        # Plain HTTP should still work alongside
+        r = requests.get('http://localhost:8000/environ/wsgi.url_scheme')
+        self.assertEqual(r.text, 'http')
+        r = requests.get('http://localhost:8000/environ/HTTPS')
+        self.assertEqual(r.text, 'None')
+
+    def test_sni(self):
+        self.start_tls()
+        self.assertEqual(self.get_certificate_name('localhost'), 'localhost')
+        self.assertEqual(self.get_certificate_name('other.test'), 'other.test')
+        # Unknown names get the first certificate
+        self.assertEqual(self.get_certificate_name('unknown.test'), 'localhost')
+
+    def test_reload(self):
+        socket_path = os.path.join(CERTS, 'control.sock')
+        self.start_tls('--processes', '2', '--control-socket', socket_path)
+        time.sleep(1)
+        self.assertEqual(self.get_certificate_name('localhost'), 'localhost')
+
+        generate_certificate('localhost')
+        # Still serving the old one
+        self.assertEqual(self.get_certificate_name('localhost'), None)
+
+        out = subprocess.run(
+            ['wsgo', 'ctl', '--control-socket', socket_path, 'certs'],
+            stdout=subprocess.PIPE, timeout=20,
+        )
+        self.assertEqual(out.returncode, 0)
+        result = json.loads(out.stdout)
+        self.assertEqual(result['processes'], {'1': {'reloaded': 2}, '2': {'reloaded': 2}})
+
+        # Every process should now have the new certificate
+        for i in range(8):
+            self.assertEqual(self.get_certificate_name('localhost'), 'localhost')
+
+    def test_http2(self):
+        self.start_tls('--http2')
+        self.assertEqual(self.get_alpn_protocol(), 'h2')
+
+        # Prior knowledge h2c: the server should answer the connection preface
+        # with a SETTINGS frame
+        with socket.create_connection(('127.0.0.1', 8000)) as s:
+            s.sendall(b'PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n' + b'\x00\x00\x00\x04\x00\x00\x00\x00\x00')
+            frame = s.makefile('rb').read(9)
+            self.assertEqual(frame[3], 4)
+
+        # HTTP/1 should still work on the same socket
+        r = requests.get('http://localhost:8000/environ/SERVER_PROTOCOL')
+        self.assertEqual(r.text, 'HTTP/1.1')
+
+        # HTTP/2 requests, over h2c and TLS
+        with socket.create_connection(('127.0.0.1', 8000), timeout=10) as s:
+            self.assertEqual(http2_get(s, 'http', '/environ/SERVER_PROTOCOL'), b'HTTP/2.0')
+        context = ssl.create_default_context()
+        context.check_hostname = False
+        context.verify_mode = ssl.CERT_NONE
+        context.set_alpn_protocols(['h2'])
+        with socket.create_connection(('127.0.0.1', 8443), timeout=10) as s:
+            with context.wrap_socket(s, server_hostname='localhost') as ss:
+                self.assertEqual(http2_get(ss, 'https', '/environ/SERVER_PROTOCOL'), b'HTTP/2.0')
+        self.stop()
+
+        # HTTP/2 is only offered when enabled
+        self.start_tls()
+        self.assertEqual(self.get_alpn_protocol(), 'http/1.1')
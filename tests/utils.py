@@ -15,13 +15,15 @@ class WsgoTestCase(unittest.TestCase):
             self.process.terminate()
             self.process.wait()
 
-    def start(self, *args):
+    def start(self, *args, env=None, **kwargs):
         self.process = subprocess.Popen(
             ['wsgo'] + list(args),
             cwd=os.path.dirname(__file__),
+            env=dict(os.environ, **env) if env else None,
             #start_new_session=True,
             stdout=subprocess.PIPE,
-            stderr=subprocess.PIPE
+            stderr=subprocess.PIPE,
+            **kwargs
         )
 
         # Pass through process stdout/stderr to system one, which might not be a
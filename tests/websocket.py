@@ -0,0 +1,185 @@
+import base64
+import os
+import requests
+import socket
+import struct
+import time
+from .utils import WsgoTestCase
+
+class WebSocketClient:
+    def __init__(self, path, protocol=None):
+        self.sock = socket.create_connection(('127.0.0.1', 8000))
+        self.sock.settimeout(10)
+        self.file = self.sock.makefile('rb')
+
+        request = (
+            'GET %s HTTP/1.1\r\n'
+            'Host: localhost\r\n'
+            'Upgrade: websocket\r\n'
+            'Connection: Upgrade\r\n'
+            'Sec-WebSocket-Key: %s\r\n'
+            'Sec-WebSocket-Version: 13\r\n'
+        ) % (path, base64.b64encode(os.urandom(16)).decode('ascii'))
+        if protocol:
+            request += 'Sec-WebSocket-Protocol: %s\r\n' % protocol
+        self.sock.sendall((request + '\r\n').encode('ascii'))
+
+        self.status = int(self.file.readline().split()[1])
+        self.headers = {}
+        while True:
+            line = self.file.readline().decode('ascii').strip()
+            if not line:
+                break
+            k, v = line.split(':', 1)
+            self.headers[k.lower()] = v.strip()
+
+    def send_frame(self, opcode, payload, fin=True, mask=True):
+        header = bytes([(0x80 if fin else 0) | opcode])
+        length = len(payload)
+        mask_bit = 0x80 if mask else 0
+        if length < 126:
+            header += bytes([mask_bit | length])
+        elif length < 65536:
+            header += bytes([mask_bit | 126]) + struct.pack('!H', length)
+        else:
+            header += bytes([mask_bit | 127]) + struct.pack('!Q', length)
+        if mask:
+            key = os.urandom(4)
+            header += key
+            payload = bytes(b ^ key[i % 4] for i, b in enumerate(payload))
+        self.sock.sendall(header + payload)
+
+    def send(self, message):
+        if isinstance(message, str):
+            self.send_frame(0x1, message.encode('utf-8'))
+        else:
+            self.send_frame(0x2, message)
+
+    def read_frame(self):
+        b1, b2 = self.file.read(2)
+        length = b2 & 0x7f
+        if length == 126:
+            length, = struct.unpack('!H', self.file.read(2))
+        elif length == 127:
+            length, = struct.unpack('!Q', self.file.read(8))
+        return b1 & 0x0f, self.file.read(length)
+
+    def read_close(self):
+        opcode, payload = self.read_frame()
+        assert opcode == 0x8, opcode
+        return struct.unpack('!H', payload[:2])[0], payload[2:].decode('utf-8')
+
+    def close(self, code=1000):
+        self.send_frame(0x8, struct.pack('!H', code))
+        return self.read_close()
+
+
+class WebSocketTests(WsgoTestCase):
+
+    def test_echo(self):
+        self.start('--module', 'wsgi_app', '--request-timeout', '1')
+        time.sleep(1)
+
+        ws = WebSocketClient('/websocket/', protocol='chat, echo')
+        self.assertEqual(ws.status, 101)
+        self.assertEqual(ws.headers['sec-websocket-protocol'], 'echo')
+
+        ws.send('hello')
+        self.assertEqual(ws.read_frame(), (0x1, b'hello'))
+        ws.send(b'\x00\x01\x02' * 50000)
+        self.assertEqual(ws.read_frame(), (0x2, b'\x00\x01\x02' * 50000))
+
+        # Fragmented, with a ping in the middle
+        ws.send_frame(0x1, b'frag', fin=False)
+        ws.send_frame(0x9, b'are you there')
+        ws.send_frame(0x0, 'mented ✓'.encode('utf-8'))
+        self.assertEqual(ws.read_frame(), (0xa, b'are you there'))
+        self.assertEqual(ws.read_frame(), (0x1, 'fragmented ✓'.encode('utf-8')))
+
+        ws.send('ping')
+        self.assertEqual(ws.read_frame(), (0x9, b'hello'))
+
+        # The request timeout doesn't apply to WebSockets
+        ws.send('sleep')
+        self.assertEqual(ws.read_frame(), (0x1, b'slept'))
+
+        self.assertEqual(ws.close(), (1000, ''))
+
+        # Normal requests still work
+        self.assertEqual(requests.get('http://localhost:8000/websocket/').status_code, 400)
+
+    def test_close(self):
+        self.start('--module', 'wsgi_app')
+        time.sleep(1)
+
+        ws = WebSocketClient('/websocket/')
+        self.assertNotIn('sec-websocket-protocol', ws.headers)
+        ws.send('close')
+        self.assertEqual(ws.read_close(), (4000, 'bye'))
+
+        # An exception in the handler
+        ws = WebSocketClient('/websocket/')
+        ws.send('raise')
+        self.assertEqual(ws.read_close(), (1011, ''))
+
+        # Protocol errors
+        ws = WebSocketClient('/websocket/')
+        ws.send_frame(0x1, b'unmasked', mask=False)
+        self.assertEqual(ws.read_close()[0], 1002)
+        ws = WebSocketClient('/websocket/')
+        ws.send_frame(0x1, b'\xff\xfe')
+        self.assertEqual(ws.read_close()[0], 1007)
+
+        # Shutting down closes any open WebSockets
+        ws = WebSocketClient('/websocket/')
+        ws.send('hello')
+        self.assertEqual(ws.read_frame(), (0x1, b'hello'))
+        self.process.terminate()
+        self.assertEqual(ws.read_close(), (1001, 'server shutting down'))
+
+    def test_idle_timeout(self):
+        self.start('--module', 'wsgi_app', '--websocket-max-message', '1000')
+        time.sleep(1)
+
+        ws = WebSocketClient('/websocket/?1')
+        # We get pinged after half the idle timeout, and answering keeps the
+        # connection open
+        self.assertEqual(ws.read_frame(), (0x9, b''))
+        ws.send_frame(0xa, b'')
+        self.assertEqual(ws.read_frame(), (0x9, b''))
+        self.assertEqual(ws.read_close(), (1001, 'idle timeout'))
+
+        ws = WebSocketClient('/websocket/')
+        ws.send('x' * 1001)
+        self.assertEqual(ws.read_close()[0], 1009)
+
+    def test_stubborn_handler(self):
+        self.start('--module', 'wsgi_app', '--workers', '1', '--request-timeout', '1', '--process', '1')
+        time.sleep(1)
+
+        # A handler which doesn't finish once the connection has closed is
+        # interrupted, freeing up its worker
+        ws = WebSocketClient('/websocket/')
+        ws.send('stubborn')
+        time.sleep(2)
+        self.assertEqual(ws.close(), (1000, ''))
+        for i in range(20):
+            if requests.get('http://localhost:8000/').status_code == 200:
+                break
+            time.sleep(0.5)
+        else:
+            self.fail('worker is still busy')
+
+        self.stop()
+
+        # Shutting down doesn't wait (up to the request timeout) for one either
+        self.start('--module', 'wsgi_app', '--process', '1')
+        time.sleep(1)
+        ws = WebSocketClient('/websocket/')
+        ws.send('stubborn')
+        time.sleep(0.5)
+        start = time.time()
+        self.process.terminate()
+        self.assertEqual(ws.read_close(), (1001, 'server shutting down'))
+        self.process.wait(timeout=60)
+        self.assertLess(time.time() - start, 30)
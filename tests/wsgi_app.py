@@ -1,6 +1,7 @@
 import atexit
 import hashlib
 import logging
+import os
 import time
 import threading
 import wsgo
@@ -15,6 +16,10 @@ def application(environ, start_response):
         return park_testing(environ, start_response)
     if environ['PATH_INFO'].startswith('/block/'):
         return block_testing(environ, start_response)
+    if environ['PATH_INFO'].startswith('/websocket/'):
+        return websocket_testing(environ, start_response)
+    if environ['PATH_INFO'].startswith('/stream/'):
+        return stream_testing(environ, start_response)
 
     h = hashlib.md5()
     if environ['REQUEST_METHOD']=='POST':
@@ -77,6 +82,42 @@ def application(environ, start_response):
         path_info = environ['PATH_INFO'].encode('iso-8859-1').decode('utf-8')
         return [path_info.encode('utf-8')]
 
+    if environ['PATH_INFO']=='/pid/':
+        return [str(os.getpid()).encode('utf-8')]
+
+    if environ['PATH_INFO']=='/remote-addr/':
+        return [environ.get('REMOTE_ADDR', '').encode('utf-8')]
+
+    if environ['PATH_INFO']=='/scheme/':
+        return [environ['wsgi.url_scheme'].encode('utf-8')]
+
+    if environ['PATH_INFO']=='/uid/':
+        return [('%d:%d' % (os.getuid(), os.getgid())).encode('utf-8')]
+
+    if environ['PATH_INFO']=='/sys-prefix/':
+        import sys
+        return [sys.prefix.encode('utf-8')]
+
+    if environ['PATH_INFO'].startswith('/getenv/'):
+        # Echo back a single process environment variable
+        key = environ['PATH_INFO'][len('/getenv/'):]
+        return [str(os.environ.get(key)).encode('utf-8')]
+
+    if environ['PATH_INFO']=='/rlimit-nofile/':
+        import resource
+        return [str(resource.getrlimit(resource.RLIMIT_NOFILE)[0]).encode('utf-8')]
+
+    if environ['PATH_INFO']=='/spawn/':
+        # Start a long-running subprocess, returning its pid
+        import subprocess
+        p = subprocess.Popen(['sleep', '600'])
+        return [str(p.pid).encode('utf-8')]
+
+    if environ['PATH_INFO'].startswith('/environ/'):
+        # Echo back a single environ variable
+        key = environ['PATH_INFO'][len('/environ/'):]
+        return [str(environ.get(key)).encode('utf-8')]
+
     if environ['PATH_INFO'].startswith('/close/'):
         class MyResponse:
             def __init__(self, data):
@@ -97,6 +138,37 @@ def application(environ, start_response):
     return [h.hexdigest().encode('utf-8')]
 
 
+def stream_testing(environ, start_response):
+    # /stream/<events>/<seconds between them>/, as Server-Sent Events (which
+    # the page cache is told it may keep, if asked), or as plain text with a
+    # Content-Length (and maybe X-Accel-Buffering) or without one, if asked
+    _, _, count, interval, _ = environ['PATH_INFO'].split('/')
+    count, interval = int(count), float(interval)
+    events = [('data: %d\n\n' % i).encode('utf-8') for i in range(count)]
+
+    if environ['QUERY_STRING'] in ('length', 'accel'):
+        headers = [
+            ('Content-Type', 'text/plain'),
+            ('Content-Length', str(sum(len(e) for e in events))),
+        ]
+        if environ['QUERY_STRING'] == 'accel':
+            headers.append(('X-Accel-Buffering', 'no'))
+    elif environ['QUERY_STRING'] == 'plain':
+        headers = [('Content-Type', 'text/plain')]
+    else:
+        headers = [('Content-Type', 'text/event-stream')]
+        if environ['QUERY_STRING'] == 'cached':
+            headers.append(('Cache-Control', 'max-age=60'))
+    start_response('200 OK', headers)
+
+    def ret():
+        for i, event in enumerate(events):
+            if i > 0:
+                time.sleep(interval)
+            yield event
+    return ret()
+
+
 def park_testing(environ, start_response):
     if environ['PATH_INFO'] == '/park/park':
         # Is this a retry?
@@ -142,6 +214,52 @@ def block_testing(environ, start_response):
 
     return [b"ignored"]
 
+def websocket_testing(environ, start_response):
+    if 'wsgo.websocket' not in environ:
+        start_response('400 Bad Request', [])
+        return [b"not a WebSocket request"]
+
+    protocol = None
+    if 'echo' in environ.get('HTTP_SEC_WEBSOCKET_PROTOCOL', ''):
+        protocol = 'echo'
+    idle_timeout = None
+    if environ['QUERY_STRING']:
+        idle_timeout = float(environ['QUERY_STRING'])
+
+    ws = wsgo.websocket(environ, protocol=protocol, idle_timeout=idle_timeout)
+    for message in ws:
+        if message == 'close':
+            ws.close(4000, 'bye')
+        elif message == 'ping':
+            ws.ping(b'hello')
+        elif message == 'sleep':
+            time.sleep(2)
+            ws.send('slept')
+        elif message == 'raise':
+            raise Exception('WebSocket handler failed')
+        elif message == 'stubborn':
+            # Carry on regardless of the connection closing
+            while True:
+                time.sleep(0.1)
+        else:
+            ws.send(message)
+    print('WebSocket closed with', ws.close_code, ws.close_reason)
+    return []
+
+def paths(environ, start_response):
+    start_response('200 OK', [
+        ('Content-Type','text/plain'),
+    ])
+    return [(environ['SCRIPT_NAME'] + '|' + environ['PATH_INFO']).encode('latin-1')]
+
+def make_app(greeting='hello'):
+    def app(environ, start_response):
+        start_response('200 OK', [
+            ('Content-Type','text/plain'),
+        ])
+        return [(greeting + ' from ' + os.getcwd()).encode('utf-8')]
+    return app
+
 def do_atexit():
     print('atexit was called')
 atexit.register(do_atexit)
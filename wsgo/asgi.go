@@ -0,0 +1,552 @@
+package wsgo
+
+/*
+#include <Python.h>
+
+extern PyObject *create_wsgi_input(long request_id);
+*/
+import "C"
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// How long to wait for a timed out request to finish after cancelling it.
+var ASGI_CANCEL_TIMEOUT = 5 * time.Second
+
+// How long to wait for each application to handle the lifespan shutdown event.
+var ASGI_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+var errAsgiStarted = errors.New("response already started")
+var errAsgiNotStarted = errors.New("response not started")
+var errAsgiComplete = errors.New("response already complete")
+var errAsgiClosed = errors.New("request is over")
+
+// An HTTP request being handled by the ASGI application on the event loop,
+// while a worker waits for it to finish.
+type AsgiRequest struct {
+	job *RequestJob
+
+	// Closed when the application has finished with the request
+	done     chan bool
+	doneOnce sync.Once
+
+	// Closed when the response is complete, or the request is over
+	complete     chan bool
+	completeOnce sync.Once
+
+	// Held while writing to the client, which can take a while, so that the
+	// worker can wait for a write to finish before giving up the response.
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	started bool
+	accel   bool
+	closed  bool
+	writing bool
+}
+
+var asgiRequests map[int64]*AsgiRequest = make(map[int64]*AsgiRequest)
+var asgiRequestsMutex sync.Mutex
+
+func AddAsgiRequest(requestId int64, job *RequestJob) *AsgiRequest {
+	ar := &AsgiRequest{
+		job:      job,
+		done:     make(chan bool),
+		complete: make(chan bool),
+	}
+	asgiRequestsMutex.Lock()
+	asgiRequests[requestId] = ar
+	asgiRequestsMutex.Unlock()
+	return ar
+}
+
+func GetAsgiRequest(requestId int64) *AsgiRequest {
+	asgiRequestsMutex.Lock()
+	defer asgiRequestsMutex.Unlock()
+	return asgiRequests[requestId]
+}
+
+// Removes a request once the worker is done with it, so that the application
+// can no longer write to it. Returns whether the response was started. Must be
+// called without the GIL held, as it waits for any write in progress.
+func RemoveAsgiRequest(requestId int64) bool {
+	asgiRequestsMutex.Lock()
+	ar := asgiRequests[requestId]
+	delete(asgiRequests, requestId)
+	asgiRequestsMutex.Unlock()
+
+	ar.mutex.Lock()
+	ar.closed = true
+	started := ar.started
+	writing := ar.writing
+	ar.mutex.Unlock()
+
+	if writing {
+		// The request is over, so don't keep waiting on a slow client.
+		http.NewResponseController(ar.job.w.writer).SetWriteDeadline(time.Now())
+	}
+	ar.writeMutex.Lock()
+	ar.writeMutex.Unlock()
+
+	ar.Complete()
+	return started
+}
+
+func (ar *AsgiRequest) Finish() {
+	ar.doneOnce.Do(func() {
+		close(ar.done)
+	})
+}
+
+func (ar *AsgiRequest) Complete() {
+	ar.completeOnce.Do(func() {
+		close(ar.complete)
+	})
+}
+
+// Waits for the application to finish with the request, returning false if it
+// didn't within the timeout (or 0 to wait forever).
+func (ar *AsgiRequest) Wait(timeout time.Duration) bool {
+	if timeout <= 0 {
+		<-ar.done
+		return true
+	}
+	select {
+	case <-ar.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Handles the http.response.start message.
+func (ar *AsgiRequest) Start(status int, headers [][2]string) error {
+	ar.writeMutex.Lock()
+	defer ar.writeMutex.Unlock()
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+	if ar.closed {
+		return errAsgiClosed
+	}
+	if ar.started {
+		return errAsgiStarted
+	}
+	ar.started = true
+
+	job := ar.job
+	for _, header := range headers {
+		if IsConnectionSpecificHeader(job.req, header[0]) {
+			continue
+		}
+		job.w.Header().Add(header[0], header[1])
+	}
+	job.statusCode = status
+
+	UpdateBlocking(job)
+
+	if CanAccelResponse(job) {
+		// The response will be done later, based on the headers alone.
+		ar.accel = true
+		return nil
+	}
+
+	job.w.WriteHeader(status)
+	return nil
+}
+
+// Handles the http.response.body message.
+func (ar *AsgiRequest) Write(body []byte, moreBody bool) error {
+	ar.writeMutex.Lock()
+	defer ar.writeMutex.Unlock()
+
+	// Only the state is checked under the mutex, not the write itself, so
+	// that the worker can close the request while a write is blocked.
+	ar.mutex.Lock()
+	if ar.closed {
+		ar.mutex.Unlock()
+		return errAsgiClosed
+	}
+	if !ar.started {
+		ar.mutex.Unlock()
+		return errAsgiNotStarted
+	}
+	select {
+	case <-ar.complete:
+		ar.mutex.Unlock()
+		return errAsgiComplete
+	default:
+	}
+	if !moreBody {
+		defer ar.Complete()
+	}
+	if ar.accel || len(body) == 0 {
+		ar.mutex.Unlock()
+		return nil
+	}
+	ar.writing = true
+	ar.mutex.Unlock()
+
+	defer func() {
+		ar.mutex.Lock()
+		ar.writing = false
+		ar.mutex.Unlock()
+	}()
+
+	n, err := ar.job.w.Write(body)
+	if err == nil && n != len(body) {
+		err = io.ErrShortWrite
+	}
+	if err == nil && moreBody {
+		// The application is streaming, so send each part as it comes.
+		err = ar.job.w.FlushToClient()
+	}
+	return err
+}
+
+// Blocks until the client disconnects, or the response is complete.
+func (ar *AsgiRequest) WaitForDisconnect() {
+	select {
+	case <-ar.job.req.Context().Done():
+	case <-ar.complete:
+	}
+}
+
+// Raises RuntimeError for a misbehaving application, or OSError if the client
+// has gone away.
+func RaiseAsgiError(err error) *C.PyObject {
+	switch err {
+	case errAsgiStarted, errAsgiNotStarted, errAsgiComplete:
+		return RaisePythonException(C.PyExc_RuntimeError, "ASGI "+err.Error())
+	}
+	return RaisePythonException(C.PyExc_OSError, "Couldn't send ASGI response: "+err.Error())
+}
+
+//export go_asgi_start
+func go_asgi_start(request_id C.long, status C.int, header_parts **C.char, header_part_lengths *C.Py_ssize_t, headers_size C.int) *C.PyObject {
+	ar := GetAsgiRequest(int64(request_id))
+	if ar == nil {
+		return RaiseAsgiError(errAsgiClosed)
+	}
+	if status < 100 || status > 999 {
+		return RaisePythonException(C.PyExc_ValueError, "invalid ASGI response status "+strconv.Itoa(int(status)))
+	}
+
+	parts := unsafe.Slice(header_parts, int(headers_size)*2)
+	lengths := unsafe.Slice(header_part_lengths, int(headers_size)*2)
+	headers := make([][2]string, headers_size)
+	for i := range headers {
+		headers[i][0] = C.GoStringN(parts[i*2], C.int(lengths[i*2]))
+		headers[i][1] = C.GoStringN(parts[i*2+1], C.int(lengths[i*2+1]))
+	}
+
+	var err error
+	WithoutGIL(func() {
+		err = ar.Start(int(status), headers)
+	})
+	if err != nil {
+		return RaiseAsgiError(err)
+	}
+	return PyNone()
+}
+
+//export go_asgi_write
+func go_asgi_write(request_id C.long, data *C.char, data_length C.Py_ssize_t, more_body C.int) *C.PyObject {
+	ar := GetAsgiRequest(int64(request_id))
+	if ar == nil {
+		return RaiseAsgiError(errAsgiClosed)
+	}
+
+	// Copy the data while we still hold the GIL
+	body := C.GoBytes(unsafe.Pointer(data), C.int(data_length))
+
+	var err error
+	WithoutGIL(func() {
+		err = ar.Write(body, more_body != 0)
+	})
+	if err != nil {
+		return RaiseAsgiError(err)
+	}
+	return PyNone()
+}
+
+//export go_asgi_wait_disconnect
+func go_asgi_wait_disconnect(request_id C.long) *C.PyObject {
+	if ar := GetAsgiRequest(int64(request_id)); ar != nil {
+		WithoutGIL(ar.WaitForDisconnect)
+	}
+	return PyNone()
+}
+
+//export go_asgi_finish
+func go_asgi_finish(request_id C.long) *C.PyObject {
+	if ar := GetAsgiRequest(int64(request_id)); ar != nil {
+		ar.Finish()
+	}
+	return PyNone()
+}
+
+// Hands a request to the event loop, and waits for the application to finish
+// with it. Must be called with the GIL held (which is released while waiting).
+func HandleAsgiJob(requestId int64, job *RequestJob) {
+	ar := AddAsgiRequest(requestId, job)
+
+	mount := FindMount(job.req.URL.Path)
+	scope := CreateAsgiScope(job.req, mount)
+	request_id := C.PyLong_FromLong(C.long(requestId))
+	input := C.create_wsgi_input(C.long(requestId))
+	ret := CallWsgoFunctionObjects("_asgi_submit", mount.app, scope, request_id, input)
+	C.Py_DecRef(scope)
+	C.Py_DecRef(request_id)
+	C.Py_DecRef(input)
+
+	if ret == nil {
+		C.PyErr_Print()
+		ar.Finish()
+	} else {
+		C.Py_DecRef(ret)
+	}
+
+	var finished bool
+	WithoutGIL(func() {
+		finished = ar.Wait(time.Duration(requestTimeout) * time.Second)
+	})
+
+	if !finished {
+		log.Println("Task timed out!")
+
+		// Cancelling raises CancelledError inside the application.
+		ret := CallWsgoFunction("_asgi_cancel", strconv.FormatInt(requestId, 10))
+		if ret == nil {
+			C.PyErr_Print()
+		} else {
+			C.Py_DecRef(ret)
+		}
+
+		WithoutGIL(func() {
+			if !ar.Wait(ASGI_CANCEL_TIMEOUT) {
+				// Only something blocking the event loop should stop the
+				// cancellation, so show what it is.
+				log.Println("Process", process, "couldn't cancel ASGI request, the event loop may be blocked")
+				PrintPythonTraceback()
+			}
+		})
+	}
+
+	var started bool
+	WithoutGIL(func() {
+		started = RemoveAsgiRequest(requestId)
+	})
+	if !started {
+		if finished {
+			log.Println("ASGI application didn't start a response")
+		}
+		SendBadGateway(job)
+	}
+}
+
+// Starts the event loop, and runs the lifespan startup event for each
+// application.
+func StartAsgi() {
+	runtime.LockOSThread()
+	gilState := C.PyGILState_Ensure()
+
+	cmd := C.CString(`
+import asyncio, concurrent.futures, threading, traceback
+import wsgo
+
+_asgi = {'loop': None, 'executor': None, 'thread': None}
+_asgi_futures = {}
+_asgi_lifespans = {}
+
+# Blocking reads and writes are done on the executor, so the event loop can
+# carry on with other requests.
+_ASGI_READ_SIZE = 65536
+
+def _asgi_start_loop(workers):
+	loop = asyncio.new_event_loop()
+	def run():
+		asyncio.set_event_loop(loop)
+		loop.run_forever()
+	_asgi['loop'] = loop
+	# Each request can be reading (or waiting for a disconnect) and writing
+	# at the same time.
+	_asgi['executor'] = concurrent.futures.ThreadPoolExecutor(int(workers) * 2, thread_name_prefix='wsgo-asgi')
+	_asgi['thread'] = threading.Thread(target=run, name='wsgo-asgi-loop', daemon=True)
+	_asgi['thread'].start()
+wsgo._asgi_start_loop = _asgi_start_loop
+
+async def _asgi_call(app, scope, request_id, input):
+	loop = _asgi['loop']
+	executor = _asgi['executor']
+	more_body = True
+
+	async def receive():
+		nonlocal more_body
+		if more_body:
+			body = await loop.run_in_executor(executor, input.read, _ASGI_READ_SIZE)
+			more_body = len(body) == _ASGI_READ_SIZE
+			return {'type': 'http.request', 'body': body, 'more_body': more_body}
+		await loop.run_in_executor(executor, wsgo._asgi_wait_disconnect, request_id)
+		return {'type': 'http.disconnect'}
+
+	async def send(message):
+		kind = message['type']
+		if kind == 'http.response.start':
+			wsgo._asgi_start(request_id, message['status'], message.get('headers', ()))
+		elif kind == 'http.response.body':
+			body = message.get('body', b'')
+			more_body = message.get('more_body', False)
+			if body:
+				await loop.run_in_executor(executor, wsgo._asgi_write, request_id, body, more_body)
+			else:
+				wsgo._asgi_write(request_id, body, more_body)
+		else:
+			raise ValueError('unexpected ASGI message type %r' % kind)
+
+	try:
+		await app(scope, receive, send)
+	except BaseException:
+		traceback.print_exc()
+
+def _asgi_submit(app, scope, request_id, input):
+	lifespan = _asgi_lifespans.get(id(app))
+	if lifespan is not None:
+		scope['state'] = dict(lifespan.state)
+	future = asyncio.run_coroutine_threadsafe(_asgi_call(app, scope, request_id, input), _asgi['loop'])
+	_asgi_futures[request_id] = future
+	def finished(future):
+		_asgi_futures.pop(request_id, None)
+		wsgo._asgi_finish(request_id)
+	future.add_done_callback(finished)
+wsgo._asgi_submit = _asgi_submit
+
+def _asgi_cancel(request_id):
+	future = _asgi_futures.get(int(request_id))
+	if future is not None:
+		future.cancel()
+wsgo._asgi_cancel = _asgi_cancel
+
+class _AsgiLifespan:
+	def __init__(self, app):
+		self.app = app
+		self.state = {}
+		self.supported = True
+		self.started = False
+
+	async def _run(self):
+		scope = {'type': 'lifespan', 'asgi': {'version': '3.0', 'spec_version': '2.0'}, 'state': self.state}
+		try:
+			await self.app(scope, self.messages.get, self.replies.put)
+		except BaseException:
+			# An exception before startup just means lifespan isn't supported
+			if self.started:
+				traceback.print_exc()
+		finally:
+			self.replies.put_nowait(None)
+
+	async def _event(self, event):
+		"""
+		Returns None if the application exited instead of replying, or the
+		message if it failed.
+		"""
+		await self.messages.put({'type': 'lifespan.' + event})
+		reply = await self.replies.get()
+		if reply is None:
+			return None
+		if reply['type'] == 'lifespan.%s.failed' % event:
+			return reply.get('message') or 'no message given'
+		return ''
+
+	async def startup(self):
+		self.messages = asyncio.Queue()
+		self.replies = asyncio.Queue()
+		self.task = asyncio.ensure_future(self._run())
+		result = await self._event('startup')
+		self.started = True
+		if result is None:
+			self.supported = False
+			print("ASGI application doesn't support lifespan events, continuing without them")
+		return result or None
+
+	async def shutdown(self):
+		if self.supported:
+			result = await self._event('shutdown')
+			if result:
+				print('ASGI lifespan shutdown failed:', result)
+
+def _asgi_startup(app):
+	lifespan = _AsgiLifespan(app)
+	_asgi_lifespans[id(app)] = lifespan
+	return asyncio.run_coroutine_threadsafe(lifespan.startup(), _asgi['loop']).result()
+wsgo._asgi_startup = _asgi_startup
+
+def _asgi_shutdown(timeout):
+	timeout = float(timeout)
+	loop = _asgi['loop']
+	for lifespan in _asgi_lifespans.values():
+		future = asyncio.run_coroutine_threadsafe(lifespan.shutdown(), loop)
+		try:
+			future.result(timeout)
+		except concurrent.futures.TimeoutError:
+			print('ASGI lifespan shutdown timed out')
+			future.cancel()
+	loop.call_soon_threadsafe(loop.stop)
+	_asgi['thread'].join(timeout)
+	_asgi['executor'].shutdown(wait=False)
+wsgo._asgi_shutdown = _asgi_shutdown
+`)
+	defer C.free(unsafe.Pointer(cmd))
+	C.PyRun_SimpleStringFlags(cmd, nil)
+
+	ret := CallWsgoFunction("_asgi_start_loop", strconv.Itoa(totalWorkers))
+	if ret == nil {
+		C.PyErr_Print()
+		ExitProcessInvalid("Couldn't start ASGI event loop")
+	}
+	C.Py_DecRef(ret)
+
+	for _, m := range mounts {
+		ret := CallWsgoFunctionObjects("_asgi_startup", m.app)
+		if ret == nil {
+			C.PyErr_Print()
+			ExitProcessInvalid("ASGI lifespan startup failed: " + m.spec)
+		}
+		if ret != C.Py_None {
+			message := "?"
+			if s := C.PyUnicode_AsUTF8(ret); s != nil {
+				message = C.GoString(s)
+			}
+			ExitProcessInvalid("ASGI lifespan startup failed: " + m.spec + ": " + message)
+		}
+		C.Py_DecRef(ret)
+	}
+
+	C.PyGILState_Release(gilState)
+	runtime.UnlockOSThread()
+}
+
+// Runs the lifespan shutdown event for each application, and stops the event
+// loop.
+func StopAsgi() {
+	runtime.LockOSThread()
+	gilState := C.PyGILState_Ensure()
+
+	ret := CallWsgoFunction("_asgi_shutdown", strconv.FormatFloat(ASGI_SHUTDOWN_TIMEOUT.Seconds(), 'f', -1, 64))
+	if ret == nil {
+		C.PyErr_Print()
+	} else {
+		C.Py_DecRef(ret)
+	}
+
+	C.PyGILState_Release(gilState)
+	runtime.UnlockOSThread()
+}
@@ -0,0 +1,109 @@
+package wsgo
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+/*
+#include <Python.h>
+*/
+import "C"
+
+// Creates the scope dict for an ASGI HTTP request. Returns a new reference.
+func CreateAsgiScope(req *http.Request, mount *Mount) *C.PyObject {
+	scope := C.PyDict_New()
+	PyDictSet(scope, "type", "http")
+
+	asgi := C.PyDict_New()
+	PyDictSet(asgi, "version", "3.0")
+	PyDictSet(asgi, "spec_version", "2.3")
+	PyDictSetObject(scope, "asgi", asgi)
+	C.Py_DecRef(asgi)
+
+	httpVersion := strings.TrimPrefix(req.Proto, "HTTP/")
+	if req.ProtoMajor == 2 {
+		httpVersion = "2"
+	}
+	PyDictSet(scope, "http_version", httpVersion)
+	PyDictSet(scope, "method", req.Method)
+	PyDictSet(scope, "scheme", RequestScheme(req))
+
+	// Unlike SCRIPT_NAME and PATH_INFO, path includes the root_path.
+	rootPath, _ := mount.SplitPath(req.URL.Path)
+	PyDictSetNew(scope, "path", PyString(req.URL.Path))
+	PyDictSetNew(scope, "raw_path", PyBytes(req.URL.EscapedPath()))
+	PyDictSetNew(scope, "root_path", PyString(rootPath))
+	PyDictSetNew(scope, "query_string", PyBytes(req.URL.RawQuery))
+
+	// Go moves the Host header out of req.Header, so put it back first.
+	headers := C.PyList_New(0)
+	AppendAsgiHeader(headers, "host", req.Host)
+	for k, vv := range req.Header {
+		k = strings.ToLower(k)
+		for _, v := range vv {
+			AppendAsgiHeader(headers, k, v)
+		}
+	}
+	PyDictSetObject(scope, "headers", headers)
+	C.Py_DecRef(headers)
+
+	PyDictSetNew(scope, "client", AsgiAddress(req.RemoteAddr))
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		PyDictSetNew(scope, "server", AsgiAddress(addr.String()))
+	}
+
+	return scope
+}
+
+// Appends a (name, value) pair of byte strings to a list of headers.
+func AppendAsgiHeader(headers *C.PyObject, name string, value string) {
+	header := C.PyTuple_New(2)
+	C.PyTuple_SetItem(header, 0, PyBytes(name))  //steals
+	C.PyTuple_SetItem(header, 1, PyBytes(value)) //steals
+	C.PyList_Append(headers, header)
+	C.Py_DecRef(header)
+}
+
+// Returns a new reference to a (host, port) tuple for a TCP address, or None
+// for anything else (such as a unix socket).
+func AsgiAddress(address string) *C.PyObject {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return PyNone()
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return PyNone()
+	}
+	tuple := C.PyTuple_New(2)
+	C.PyTuple_SetItem(tuple, 0, PyString(host))                  //steals
+	C.PyTuple_SetItem(tuple, 1, C.PyLong_FromLong(C.long(port))) //steals
+	return tuple
+}
+
+// Returns a new reference to a str, decoded from UTF-8 (replacing anything
+// invalid, since paths can contain arbitrary escaped bytes).
+func PyString(s string) *C.PyObject {
+	cs := C.CString(s)
+	defer C.free(unsafe.Pointer(cs))
+	errors := C.CString("replace")
+	defer C.free(unsafe.Pointer(errors))
+	return C.PyUnicode_DecodeUTF8(cs, C.Py_ssize_t(len(s)), errors)
+}
+
+// Returns a new reference to a bytes object.
+func PyBytes(s string) *C.PyObject {
+	cs := C.CString(s)
+	defer C.free(unsafe.Pointer(cs))
+	return C.PyBytes_FromStringAndSize(cs, C.Py_ssize_t(len(s)))
+}
+
+// As PyDictSetObject, but steals the reference to obj.
+func PyDictSetNew(dict *C.PyObject, key string, obj *C.PyObject) {
+	PyDictSetObject(dict, key, obj)
+	C.Py_DecRef(obj)
+}
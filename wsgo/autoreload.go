@@ -0,0 +1,130 @@
+package wsgo
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+/*
+#include <Python.h>
+*/
+import "C"
+
+// How often to check the watched files for changes.
+var AUTORELOAD_INTERVAL = 1 * time.Second
+
+// Returns the files of every imported module (plus any files mentioned in the
+// last import error), along with any files matching the extra globs.
+func GetAutoreloadFiles() []string {
+	files := callFileListFunction("_autoreload_files")
+
+	for _, pattern := range pyAutoreloadGlobs {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Println("Bad autoreload glob:", pattern, err)
+			continue
+		}
+		files = append(files, matches...)
+	}
+
+	return files
+}
+
+// Calls a wsgo function which returns a list of filenames.
+func callFileListFunction(name string, args ...string) []string {
+	var files []string
+
+	runtime.LockOSThread()
+	gilState := C.PyGILState_Ensure()
+
+	ret := CallWsgoFunction(name, args...)
+	if ret == nil {
+		C.PyErr_Print()
+	} else {
+		for i := 0; i < int(C.PyList_Size(ret)); i++ {
+			item := C.PyList_GetItem(ret, C.Py_ssize_t(i)) // borrowed reference
+			s := C.PyUnicode_AsUTF8(item)
+			if s == nil {
+				C.PyErr_Clear()
+				continue
+			}
+			files = append(files, C.GoString(s))
+		}
+		C.Py_DecRef(ret)
+	}
+
+	C.PyGILState_Release(gilState)
+	runtime.UnlockOSThread()
+
+	return files
+}
+
+func getModTime(file string) time.Time {
+	stat, err := os.Stat(file)
+	if err != nil {
+		// A missing file counts as a change too
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
+
+// Records the modification times of files, returning whether any of the
+// previously seen ones have changed. Newly seen files don't count as changes.
+func checkModTimes(modTimes map[string]time.Time, files []string) bool {
+	changed := false
+	for _, file := range files {
+		t := getModTime(file)
+		previous, seen := modTimes[file]
+		if seen && !t.Equal(previous) {
+			log.Println("Process", process, "detected change in", file)
+			changed = true
+		}
+		modTimes[file] = t
+	}
+	return changed
+}
+
+// Blocks until the given files change, and then stay unchanged for an
+// interval (so that we don't restart part way through an editor saving).
+func WaitForChanges(getFiles func() []string) {
+	modTimes := make(map[string]time.Time)
+	checkModTimes(modTimes, getFiles())
+
+	changed := false
+	for {
+		time.Sleep(AUTORELOAD_INTERVAL)
+		if checkModTimes(modTimes, getFiles()) {
+			changed = true
+		} else if changed {
+			return
+		}
+	}
+}
+
+// Restarts the process whenever any imported Python files change.
+func AutoreloadRoutine() {
+	WaitForChanges(GetAutoreloadFiles)
+	RestartProcess("Python source changed")
+}
+
+// Called when the application couldn't be imported. Rather than exiting (and
+// crash-looping), wait until the broken files have been fixed and then exit so
+// the process manager can try again. As the failure may have been before any
+// of the application was imported (such as the module not being found), we
+// also watch where the module would be found, including the --chdir and
+// --pythonpath directories. Must be called with the GIL held.
+func WaitForChangesAfterImportError(spec string) {
+	files := append(GetAutoreloadFiles(), callFileListFunction("_autoreload_import_files", spec)...)
+	log.Println("Process", process, "waiting for changes before trying again...")
+
+	threadState := C.PyEval_SaveThread()
+	WaitForChanges(func() []string {
+		return files
+	})
+	C.PyEval_RestoreThread(threadState)
+
+	os.Exit(EXITCODE_RESTART)
+}
@@ -133,7 +133,11 @@ func Block(req *http.Request, seconds int) {
 		// Don't block internal addresses
 		return
 	}
-	
+
+	BlockAddress(ip, seconds)
+}
+
+func BlockAddress(ip string, seconds int) {
 	log.Println("- blocking", ip, "for", seconds, "seconds")
 
 	blockedMutex.Lock()
@@ -141,3 +145,15 @@ func Block(req *http.Request, seconds int) {
 	blockedMutex.Unlock()
 	blockCount.Add(1)
 }
+
+// Removes any block on an address, returning whether there was one.
+func UnblockAddress(ip string) bool {
+	blockedMutex.Lock()
+	defer blockedMutex.Unlock()
+
+	if _, ok := blocked[ip]; !ok {
+		return false
+	}
+	ExpireBlock(ip)
+	return true
+}
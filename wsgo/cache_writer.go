@@ -174,6 +174,15 @@ func (cw *CacheWriter) Flush() error {
 	return err
 }
 
+// Sends what has been written so far on to the client, without finishing the
+// response (unlike Flush). Does nothing while we're still buffering.
+func (cw *CacheWriter) FlushToClient() error {
+	if cw.finished || cw.writer == nil || !cw.doneBuffering {
+		return nil
+	}
+	return http.NewResponseController(cw.writer).Flush()
+}
+
 func (cw *CacheWriter) WriteHeader(statusCode int) {
 	if cw.finished {
 		return
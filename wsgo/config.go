@@ -3,9 +3,15 @@ package wsgo
 import (
 	"errors"
 	"flag"
+	"os"
 	"strings"
 )
 
+// Flags that can be given more than once.
+type repeatableFlag interface {
+	Values() []string
+}
+
 type staticMapping [][2]string
 
 func (i *staticMapping) String() string {
@@ -21,6 +27,29 @@ func (i *staticMapping) Set(value string) error {
 	return nil
 }
 
+func (i *staticMapping) Values() []string {
+	var ret []string
+	for _, m := range *i {
+		ret = append(ret, m[0]+"="+m[1])
+	}
+	return ret
+}
+
+type stringList []string
+
+func (i *stringList) String() string {
+	return "?"
+}
+
+func (i *stringList) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+func (i *stringList) Values() []string {
+	return *i
+}
+
 type heavyPrefix []string
 
 func (i *heavyPrefix) String() string {
@@ -34,10 +63,43 @@ func (i *heavyPrefix) Set(value string) error {
 
 var totalWorkers int = 16     //total number of worker threads
 var processes int = 1
+var minProcesses int = 0
+var maxProcesses int = 0
 var process int = 0
-var bindAddress string = ":8000"
+var bindAddresses stringList
+var httpsAddresses stringList
+var tlsCertFiles stringList
+var tlsKeyFiles stringList
+var socketMode string
+var socketOwner string
+var sharedSocket bool = false
+var proxyProtocolAddresses stringList
+var trustedProxies stringList
+var enableHTTP2 bool = false
+var websocketIdleTimeout int = 60
+var websocketMaxMessage int = 16777216
+var runAsUid string
+var runAsGid string
+var runAsGroups string
+var chrootDir string
+var controlSocket string
+var cpuAffinity string = "per-process"
+var childEnv stringList
+var childUnsetEnv stringList
+var limitAs string
+var limitNofile string
+var limitCore string
+var processGroup bool = false
+var inheritedSocketList inheritedSockets
+var managerFd int = 0
 var wsgiModule string = "wsgi_app"
+var asgiMode bool = false
+var mountSpecs stringList
+var chdir string
+var pythonPaths stringList
+var virtualenv string
 var requestTimeout int = 60
+var streamingTimeout int = 3600
 var backgroundTimeout int = 1800
 var maxQueueLength int = 128
 var requestBufferLength int = 1048576
@@ -48,18 +110,158 @@ var maxAgeBeforeRefetch int = 0
 var pageCacheLimit uint64 = 67108864
 var staticMap staticMapping
 var staticMaxAge int = 86400
+var maxRequests int = 0
+var maxLifetime int = 0
+var reloadOnRss int = 0
+var recycleJitter int = 10
+var heartbeatTimeout int = 30
+var restartDelayMax int = 30
+var crashLimit int = 10
+var crashWindow int = 60
+var pyAutoreload bool = false
+var pyAutoreloadGlobs stringList
+var configFile string
+var printConfig bool = false
+
+// Options used internally between the process manager and its children.
+var internalOptions = []string{"process", "inherited-socket", "manager-fd"}
+
+// Alternative names for options, which set the same value.
+var optionAliases = map[string]string{"home": "virtualenv"}
+
+func canonicalOption(name string) string {
+	if canonical, ok := optionAliases[name]; ok {
+		return canonical
+	}
+	return name
+}
+
+// Where each option was set from, for --print-config.
+var optionSources map[string]string = make(map[string]string)
 
 func ParseFlags() {
 	flag.IntVar(&totalWorkers, "workers", totalWorkers, "total number of worker threads")
 	flag.IntVar(&processes, "processes", processes, "number of processes")
+	flag.IntVar(&minProcesses, "min-processes", minProcesses, "minimum number of processes when scaling with load (default --processes)")
+	flag.IntVar(&maxProcesses, "max-processes", maxProcesses, "maximum number of processes when scaling with load (default --processes)")
 	flag.IntVar(&process, "process", process, "process number (internal)")
-	flag.StringVar(&wsgiModule, "module", wsgiModule, "WSGI module to serve")
-	flag.StringVar(&bindAddress, "http-socket", bindAddress, "server bind address")
+	flag.StringVar(&wsgiModule, "module", wsgiModule, "WSGI module to serve, as module, module:callable or module:factory(args)")
+	flag.BoolVar(&asgiMode, "asgi", asgiMode, "serve ASGI applications (run on an asyncio event loop) instead of WSGI ones")
+	flag.Var(&mountSpecs, "mount", "serve an application under a URL prefix, as /prefix=module:callable (can be given more than once, replaces --module)")
+	flag.StringVar(&chdir, "chdir", chdir, "directory to change into before loading the application")
+	flag.StringVar(&virtualenv, "virtualenv", virtualenv, "virtualenv to load the application from")
+	flag.StringVar(&virtualenv, "home", virtualenv, "alias for --virtualenv")
+	flag.Var(&pythonPaths, "pythonpath", "directory to add to the start of sys.path (can be given more than once)")
+	flag.Var(&bindAddresses, "http-socket", "server bind address, or unix:<path> (can be given more than once, default :8000)")
+	flag.Var(&httpsAddresses, "https-socket", "HTTPS server bind address, or unix:<path> (can be given more than once)")
+	flag.Var(&tlsCertFiles, "tls-cert", "TLS certificate file (can be given more than once, paired with --tls-key)")
+	flag.Var(&tlsKeyFiles, "tls-key", "TLS private key file (can be given more than once, paired with --tls-cert)")
+	flag.StringVar(&socketMode, "socket-mode", socketMode, "file permissions for unix sockets, in octal (eg 660)")
+	flag.StringVar(&socketOwner, "socket-owner", socketOwner, "user[:group] to own unix sockets")
+	flag.BoolVar(&enableHTTP2, "http2", enableHTTP2, "serve HTTP/2, negotiated via ALPN on HTTPS sockets and with prior knowledge (h2c) on plain ones")
+	flag.IntVar(&websocketIdleTimeout, "websocket-idle-timeout", websocketIdleTimeout, "close WebSockets that have been silent for this many seconds, pinging them half way (0 to disable)")
+	flag.IntVar(&websocketMaxMessage, "websocket-max-message", websocketMaxMessage, "maximum size in bytes of a received WebSocket message")
+	flag.Var(&proxyProtocolAddresses, "proxy-protocol", "expect a PROXY protocol (v1 or v2) header on connections to this listening address, or systemd:<name> (can be given more than once)")
+	flag.Var(&trustedProxies, "trusted-proxy", "CIDR or address of a proxy whose X-Forwarded-For/Forwarded headers are believed (can be given more than once, default loopback and private addresses)")
+	flag.BoolVar(&sharedSocket, "shared-socket", sharedSocket, "bind TCP sockets once in the process manager and share them with every process")
+	flag.StringVar(&runAsUid, "uid", runAsUid, "user (name or id) to run the application as, after opening sockets")
+	flag.StringVar(&runAsGid, "gid", runAsGid, "group (name or id) to run the application as (default the --uid user's group)")
+	flag.StringVar(&runAsGroups, "groups", runAsGroups, "comma-separated supplementary groups (default the --uid user's groups)")
+	flag.StringVar(&chrootDir, "chroot", chrootDir, "chroot into this directory before importing the application")
+	flag.StringVar(&controlSocket, "control-socket", controlSocket, "unix socket path for 'wsgo ctl' commands")
+	flag.Var(&inheritedSocketList, "inherited-socket", "socket inherited from the process manager (internal)")
+	flag.IntVar(&managerFd, "manager-fd", managerFd, "fd of the channel to the process manager (internal)")
+	flag.StringVar(&cpuAffinity, "cpu-affinity", cpuAffinity, "how to pin worker threads to CPUs: none, per-process, numa or list:<cpus> (eg list:0-3,8)")
+	flag.Var(&childEnv, "env", "set an environment variable for the processes, as KEY=VALUE (can be given more than once)")
+	flag.Var(&childUnsetEnv, "unset-env", "remove an environment variable for the processes (can be given more than once)")
+	flag.StringVar(&limitAs, "limit-as", limitAs, "address space limit for each process in megabytes, or 'unlimited'")
+	flag.StringVar(&limitNofile, "limit-nofile", limitNofile, "open file limit for each process, or 'unlimited'")
+	flag.StringVar(&limitCore, "limit-core", limitCore, "core dump size limit for each process in megabytes, or 'unlimited'")
+	flag.BoolVar(&processGroup, "process-group", processGroup, "run each process in its own process group, and kill anything left in it when the process exits")
 	flag.IntVar(&requestTimeout, "request-timeout", requestTimeout, "request timeout in seconds")
+	flag.IntVar(&streamingTimeout, "streaming-timeout", streamingTimeout, "time limit in seconds for streamed responses, in place of the request timeout (0 to disable)")
 	flag.IntVar(&maxAge, "max-age", maxAge, "maximum number of seconds to cache responses (0 to disable)")
-	maxAgeBeforeRefetch = maxAge / 2
 	flag.Uint64Var(&pageCacheLimit, "cache-size", pageCacheLimit, "maximum size of page cache in bytes")
 	flag.Var(&staticMap, "static-map", "static file folder mapping")
 	flag.IntVar(&staticMaxAge, "static-max-age", staticMaxAge, "encourage clients to cache static files for this many seconds (0 to disable)")
+	flag.IntVar(&maxRequests, "max-requests", maxRequests, "recycle each process after this many requests (0 to disable)")
+	flag.IntVar(&maxLifetime, "max-lifetime", maxLifetime, "recycle each process after this many seconds (0 to disable)")
+	flag.IntVar(&reloadOnRss, "reload-on-rss", reloadOnRss, "recycle a process once its RSS exceeds this many megabytes (0 to disable)")
+	flag.IntVar(&recycleJitter, "recycle-jitter", recycleJitter, "randomly extend --max-requests and --max-lifetime by up to this percentage")
+	flag.IntVar(&heartbeatTimeout, "heartbeat-timeout", heartbeatTimeout, "kill and restart a process if it stops heartbeating for this many seconds (0 to disable)")
+	flag.IntVar(&restartDelayMax, "restart-delay-max", restartDelayMax, "maximum seconds to wait before restarting a crashed process")
+	flag.IntVar(&crashLimit, "crash-limit", crashLimit, "exit if processes crash more than this many times within --crash-window (0 to disable)")
+	flag.IntVar(&crashWindow, "crash-window", crashWindow, "window in seconds for --crash-limit")
+	flag.BoolVar(&pyAutoreload, "py-autoreload", pyAutoreload, "restart when imported Python files change (for development)")
+	flag.Var(&pyAutoreloadGlobs, "py-autoreload-glob", "extra files to watch with --py-autoreload (can be given more than once)")
+	flag.StringVar(&configFile, "config", configFile, "load options from a TOML/INI/YAML config file")
+	flag.BoolVar(&printConfig, "print-config", printConfig, "print the effective configuration at startup")
 	flag.Parse()
+
+	// Options are taken from the command line first, then the config file,
+	// then WSGO_* environment variables.
+	flag.Visit(func(f *flag.Flag) {
+		optionSources[canonicalOption(f.Name)] = "command line"
+	})
+
+	// Processes started by the process manager are given all of its options
+	// on the command line, so they don't read the config file or environment
+	// again (which may have changed since the manager started).
+	if managerFd == 0 {
+		if configFile == "" {
+			configFile = os.Getenv(EnvironmentVariableName("config"))
+		}
+		if configFile != "" {
+			if err := LoadConfigFile(configFile); err != nil {
+				ExitProcessInvalid("Couldn't load config file: " + err.Error())
+			}
+		}
+
+		if err := LoadEnvironment(); err != nil {
+			ExitProcessInvalid("Couldn't load environment: " + err.Error())
+		}
+	}
+
+	// Now that --max-age is known from all of the sources
+	maxAgeBeforeRefetch = maxAge / 2
+
+	if len(bindAddresses) == 0 && len(httpsAddresses) == 0 && SystemdListenFds() == 0 {
+		bindAddresses = stringList{":8000"}
+	}
+
+	for _, validate := range []func() error{
+		ValidateCpuAffinity,
+		ValidateChildEnvironment,
+		ValidateResourceLimits,
+		ValidateMounts,
+		ValidateProxyProtocol,
+		ParseTrustedProxies,
+	} {
+		if err := validate(); err != nil {
+			ExitProcessInvalid(err.Error())
+		}
+	}
+
+	if printConfig {
+		PrintConfig()
+	}
+}
+
+// Returns the arguments needed to start a child process with the same
+// resolved configuration as this one.
+func ChildArgs() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" || contains(internalOptions, f.Name) {
+			return
+		}
+		if r, ok := f.Value.(repeatableFlag); ok {
+			for _, v := range r.Values() {
+				args = append(args, "--"+f.Name+"="+v)
+			}
+		} else {
+			args = append(args, "--"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args
 }
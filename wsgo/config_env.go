@@ -0,0 +1,79 @@
+package wsgo
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+func EnvironmentVariableName(option string) string {
+	return "WSGO_" + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
+
+// Applies any WSGO_* environment variables to flags which weren't already set
+// on the command line or in a config file. Options that can be given more than
+// once take one value per line, since the values themselves may contain commas.
+func LoadEnvironment() error {
+	alreadySet := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		alreadySet[canonicalOption(f.Name)] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || alreadySet[canonicalOption(f.Name)] || contains(internalOptions, f.Name) {
+			return
+		}
+		name := EnvironmentVariableName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+
+		values := []string{value}
+		if _, ok := f.Value.(repeatableFlag); ok {
+			values = splitLines(value)
+		}
+		for _, v := range values {
+			if e := flag.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid value for %s: %v", name, e)
+				return
+			}
+		}
+		optionSources[canonicalOption(f.Name)] = "environment " + name
+		alreadySet[canonicalOption(f.Name)] = true
+	})
+	return err
+}
+
+func splitLines(str string) []string {
+	var ret []string
+	for _, s := range strings.Split(str, "\n") {
+		s = strings.TrimSpace(s)
+		if len(s) > 0 {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// Logs the value of every option, along with where it was set from.
+func PrintConfig() {
+	log.Println("Effective configuration:")
+	flag.VisitAll(func(f *flag.Flag) {
+		if contains(internalOptions, f.Name) || optionAliases[f.Name] != "" {
+			return
+		}
+		value := f.Value.String()
+		if r, ok := f.Value.(repeatableFlag); ok {
+			value = strings.Join(r.Values(), ", ")
+		}
+		source := optionSources[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		log.Printf("  %s = %s (%s)\n", f.Name, value, source)
+	})
+}
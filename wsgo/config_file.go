@@ -0,0 +1,235 @@
+package wsgo
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A single `key = value` setting read from a config file.
+type configEntry struct {
+	key   string
+	value string
+	line  int
+}
+
+var configKeyValue = regexp.MustCompile(`^([A-Za-z0-9_-]+)\s*[=:]\s*(.*)$`)
+
+func normaliseConfigKey(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+func stripConfigComment(line string) string {
+	// Remove a trailing ` # comment`, as long as the # isn't inside quotes.
+	var quote rune
+	for i, c := range line {
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+		} else if c == '"' || c == '\'' {
+			quote = c
+		} else if c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return line
+}
+
+func unquoteConfigValue(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return strconv.Unquote(value)
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1], nil
+	}
+	return value, nil
+}
+
+func splitConfigArray(value string) ([]string, error) {
+	// Split the contents of a TOML-style ["a", "b"] array.
+	var ret []string
+	var quote rune
+	start := 0
+	for i, c := range value {
+		if quote != 0 {
+			if c == quote && (quote == '\'' || i == 0 || value[i-1] != '\\') {
+				quote = 0
+			}
+		} else if c == '"' || c == '\'' {
+			quote = c
+		} else if c == ',' {
+			ret = append(ret, value[start:i])
+			start = i + 1
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated string in array")
+	}
+	ret = append(ret, value[start:])
+
+	var values []string
+	for _, v := range ret {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		v, err := unquoteConfigValue(v)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// Reads a config file, which may be written as TOML, INI or YAML, as long as
+// it only contains top-level `key = value` (or `key: value`) settings. Lists
+// can be given as TOML arrays, YAML `- item` lines, or by repeating the key.
+func ReadConfigFile(filename string) ([]configEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []configEntry
+
+	// The key of a YAML list or multi-line TOML array we're in the middle of.
+	listKey := ""
+	arrayValue := ""
+	arrayLine := 0
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+
+		if arrayValue != "" {
+			// Continuing a multi-line TOML array
+			arrayValue += " " + stripConfigComment(line)
+			if !strings.HasSuffix(arrayValue, "]") {
+				continue
+			}
+			values, err := splitConfigArray(arrayValue[1 : len(arrayValue)-1])
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", filename, arrayLine, err)
+			}
+			for _, v := range values {
+				entries = append(entries, configEntry{listKey, v, arrayLine})
+			}
+			arrayValue = ""
+			listKey = ""
+			continue
+		}
+
+		if line == "" || line == "---" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		line = stripConfigComment(line)
+
+		if line[0] == '[' {
+			// INI/TOML section header, only the [wsgo] section is allowed
+			section := strings.TrimSpace(strings.Trim(line, "[]"))
+			if section != "wsgo" {
+				return nil, fmt.Errorf("%s line %d: unknown section [%s]", filename, n, section)
+			}
+			listKey = ""
+			continue
+		}
+
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			// YAML list item
+			if listKey == "" {
+				return nil, fmt.Errorf("%s line %d: list item without a key", filename, n)
+			}
+			v, err := unquoteConfigValue(strings.TrimPrefix(line, "-"))
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", filename, n, err)
+			}
+			entries = append(entries, configEntry{listKey, v, n})
+			continue
+		}
+
+		m := configKeyValue.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("%s line %d: expected 'key = value'", filename, n)
+		}
+		key, value := normaliseConfigKey(m[1]), strings.TrimSpace(m[2])
+		listKey = ""
+
+		if value == "" {
+			// Might be followed by a YAML list
+			listKey = key
+			continue
+		}
+
+		if value[0] == '[' {
+			// TOML array, possibly spread over multiple lines
+			listKey = key
+			if !strings.HasSuffix(value, "]") {
+				arrayValue = value
+				arrayLine = n
+				continue
+			}
+			values, err := splitConfigArray(value[1 : len(value)-1])
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", filename, n, err)
+			}
+			for _, v := range values {
+				entries = append(entries, configEntry{key, v, n})
+			}
+			listKey = ""
+			continue
+		}
+
+		value, err := unquoteConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", filename, n, err)
+		}
+		entries = append(entries, configEntry{key, value, n})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if arrayValue != "" {
+		return nil, fmt.Errorf("%s line %d: unterminated array", filename, arrayLine)
+	}
+
+	return entries, nil
+}
+
+// Applies the settings in a config file to any flags which weren't already set
+// on the command line.
+func LoadConfigFile(filename string) error {
+	entries, err := ReadConfigFile(filename)
+	if err != nil {
+		return err
+	}
+
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[canonicalOption(f.Name)] = true
+	})
+
+	for _, entry := range entries {
+		f := flag.Lookup(entry.key)
+		if f == nil || entry.key == "config" || contains(internalOptions, entry.key) {
+			return fmt.Errorf("%s line %d: unknown option '%s'", filename, entry.line, entry.key)
+		}
+		if setOnCommandLine[canonicalOption(entry.key)] {
+			continue
+		}
+		if err := flag.Set(entry.key, entry.value); err != nil {
+			return fmt.Errorf("%s line %d: invalid value for '%s': %v", filename, entry.line, entry.key, err)
+		}
+		optionSources[canonicalOption(entry.key)] = "config file " + filename
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package wsgo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long to wait for each process to respond to a control command.
+var CONTROL_TIMEOUT = 10 * time.Second
+
+var processStartTime = time.Now()
+
+var controlListener net.Listener
+
+// A command sent to the control socket.
+type ControlRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// Replies to control commands which have been passed on to the child
+// processes, by request id.
+var controlReplies map[int]chan ProcessMessage = make(map[int]chan ProcessMessage)
+var controlRepliesMutex sync.Mutex
+var lastControlId int
+
+// Checks a command and its arguments, returning whether it should be passed
+// on to the child processes.
+func ValidateControlRequest(req ControlRequest) (bool, error) {
+	switch req.Command + "/" + strconv.Itoa(len(req.Args)) {
+	case "status/0", "stacks/0", "certs/0":
+		return true, nil
+	case "reload/0", "stop/0":
+		return false, nil
+	case "block/2":
+		if net.ParseIP(req.Args[0]) == nil {
+			return false, errors.New("invalid IP address " + req.Args[0])
+		}
+		if _, err := strconv.Atoi(req.Args[1]); err != nil {
+			return false, errors.New("invalid number of seconds " + req.Args[1])
+		}
+		return true, nil
+	case "unblock/1":
+		return true, nil
+	case "cache/2":
+		if req.Args[0] == "purge" {
+			return true, nil
+		}
+	}
+	return false, errors.New("unknown command (expected status, reload, stop, block <ip> <secs>, unblock <ip>, cache purge <prefix>, stacks or certs)")
+}
+
+// Passes a command on to every child process, returning their results by
+// process number.
+func FanOutControlRequest(req ControlRequest) map[string]interface{} {
+	childProcessesMutex.Lock()
+	var children []*ChildProcess
+	for _, child := range childProcesses {
+		if child != nil {
+			children = append(children, child)
+		}
+	}
+	childProcessesMutex.Unlock()
+
+	controlRepliesMutex.Lock()
+	lastControlId++
+	id := lastControlId
+	replies := make(chan ProcessMessage, len(children))
+	controlReplies[id] = replies
+	controlRepliesMutex.Unlock()
+
+	defer func() {
+		controlRepliesMutex.Lock()
+		delete(controlReplies, id)
+		controlRepliesMutex.Unlock()
+	}()
+
+	results := make(map[string]interface{})
+	pending := make(map[int]bool)
+	for _, child := range children {
+		err := SendProcessMessage(child.conn, ProcessMessage{
+			Type:    "control",
+			ID:      id,
+			Command: req.Command,
+			Args:    req.Args,
+		})
+		if err != nil {
+			results[strconv.Itoa(child.number)] = map[string]string{"error": err.Error()}
+			continue
+		}
+		pending[child.number] = true
+	}
+
+	timeout := time.After(CONTROL_TIMEOUT)
+	for len(pending) > 0 {
+		select {
+		case msg := <-replies:
+			delete(pending, msg.Process)
+			if msg.Error != "" {
+				results[strconv.Itoa(msg.Process)] = map[string]string{"error": msg.Error}
+			} else {
+				results[strconv.Itoa(msg.Process)] = msg.Result
+			}
+		case <-timeout:
+			for number := range pending {
+				results[strconv.Itoa(number)] = map[string]string{"error": "timed out"}
+			}
+			return results
+		}
+	}
+	return results
+}
+
+// Delivers a child's reply to a control command.
+func HandleControlReply(msg ProcessMessage) {
+	controlRepliesMutex.Lock()
+	replies := controlReplies[msg.ID]
+	controlRepliesMutex.Unlock()
+	if replies != nil {
+		// Don't hold up the caller if a process replies more than once, or
+		// the request has already given up waiting.
+		select {
+		case replies <- msg:
+		default:
+		}
+	}
+}
+
+func RunControlRequest(req ControlRequest) map[string]interface{} {
+	fanOut, err := ValidateControlRequest(req)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+
+	response := make(map[string]interface{})
+	switch req.Command {
+	case "status":
+		childProcessesMutex.Lock()
+		var slots []int
+		for n := range childProcesses {
+			slots = append(slots, n)
+		}
+		childProcessesMutex.Unlock()
+		sort.Ints(slots)
+
+		response["manager"] = map[string]interface{}{
+			"pid":       os.Getpid(),
+			"uptime":    int(time.Since(processStartTime).Seconds()),
+			"processes": slots,
+		}
+	case "reload":
+		go RollingRestart()
+		response["result"] = "rolling restart started"
+	case "stop":
+		go StopChildProcesses()
+		response["result"] = "stopping"
+	}
+
+	if fanOut {
+		response["processes"] = FanOutControlRequest(req)
+	}
+	return response
+}
+
+func HandleControlConnection(conn net.Conn) {
+	defer conn.Close()
+
+	var req ControlRequest
+	var response map[string]interface{}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &req)
+	}
+	if err != nil {
+		response = map[string]interface{}{"error": "invalid request: " + err.Error()}
+	} else {
+		response = RunControlRequest(req)
+	}
+
+	b, _ := marshalUnescaped(response)
+	conn.Write(append(b, '\n'))
+}
+
+// Like json.Marshal, but leaves <, > and & alone (as they're common in stack
+// traces).
+func marshalUnescaped(v interface{}) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+	return bytes.TrimRight(buf.Bytes(), "\n"), err
+}
+
+// Listens for commands on the control socket (which only the user wsgo is
+// running as can connect to).
+func RunControlSocket() {
+	if controlSocket == "" {
+		return
+	}
+	if err := RemoveStaleSocket(controlSocket); err != nil {
+		ExitProcessInvalid("Couldn't open control socket: " + err.Error())
+	}
+	// Create the socket as 0600 to begin with, rather than changing its mode
+	// afterwards, so there's no moment when anyone else could connect.
+	oldUmask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", controlSocket)
+	syscall.Umask(oldUmask)
+	if err != nil {
+		ExitProcessInvalid("Couldn't open control socket: " + err.Error())
+	}
+	controlListener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go HandleControlConnection(conn)
+		}
+	}()
+}
+
+func CloseControlSocket() {
+	if controlListener != nil {
+		controlListener.Close()
+	}
+}
+
+// Runs a control command in a child process.
+func RunChildControlCommand(command string, args []string) (interface{}, error) {
+	switch command {
+	case "status":
+		scheduler.jobQueueMutex.Lock()
+		queueLength := len(scheduler.jobQueue)
+		scheduler.jobQueueMutex.Unlock()
+
+		pageCacheMutex.Lock()
+		cacheEntries := 0
+		for _, entries := range pageCache {
+			cacheEntries += len(entries)
+		}
+		cacheSize := pageCacheSize
+		pageCacheMutex.Unlock()
+
+		blockedMutex.Lock()
+		blockedAddresses := len(blocked)
+		blockedMutex.Unlock()
+
+		return map[string]interface{}{
+			"pid":               os.Getpid(),
+			"uptime":            int(time.Since(processStartTime).Seconds()),
+			"rss":               GetRss(),
+			"goroutines":        runtime.NumGoroutine(),
+			"requests":          requestCount.Load(),
+			"errors":            errorCount.Load(),
+			"timeouts":          timeoutCount.Load(),
+			"drops":             droppedCount.Load(),
+			"blocks":            blockCount.Load(),
+			"blocked_requests":  blockedCount.Load(),
+			"blocked_addresses": blockedAddresses,
+			"active_requests":   scheduler.activeRequests.Load(),
+			"queue_length":      queueLength,
+			"cache_entries":     cacheEntries,
+			"cache_size":        cacheSize,
+			"workers":           GetWorkerStates(),
+		}, nil
+	case "block":
+		seconds, _ := strconv.Atoi(args[1])
+		BlockAddress(args[0], seconds)
+		return map[string]interface{}{"blocked": args[0], "seconds": seconds}, nil
+	case "unblock":
+		return map[string]interface{}{"unblocked": UnblockAddress(args[0])}, nil
+	case "cache":
+		return map[string]interface{}{"purged": PurgeCache(args[1])}, nil
+	case "stacks":
+		return map[string]interface{}{"stacks": GetPythonStacks()}, nil
+	case "certs":
+		if err := ReloadCertificates(); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"reloaded": len(tlsCertFiles)}, nil
+	}
+	return nil, errors.New("unknown command " + command)
+}
+
+// Handles a message from the process manager.
+func HandleManagerMessage(msg ProcessMessage) {
+	if msg.Type == "scaling" {
+		childMaxProcesses.Store(int64(msg.MaxProcesses))
+		return
+	}
+	if msg.Type != "control" {
+		return
+	}
+	go func() {
+		reply := ProcessMessage{
+			Type:    "control-result",
+			ID:      msg.ID,
+			Process: process,
+		}
+		result, err := RunChildControlCommand(msg.Command, msg.Args)
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.Result, _ = marshalUnescaped(result)
+		}
+		NotifyManager(reply)
+	}()
+}
+
+// The 'wsgo ctl' client, which sends a command to a running wsgo's control
+// socket and prints the result.
+func RunControlClient(args []string) {
+	flags := flag.NewFlagSet("wsgo ctl", flag.ExitOnError)
+	socket := flags.String("control-socket", os.Getenv(EnvironmentVariableName("control-socket")), "path of the control socket")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: wsgo ctl [--control-socket <path>] <command> [<args>...]")
+		fmt.Fprintln(flags.Output(), "Commands: status, reload, stop, block <ip> <secs>, unblock <ip>, cache purge <prefix>, stacks, certs")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *socket == "" || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't connect to control socket:", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	req, _ := json.Marshal(ControlRequest{
+		Command: flags.Arg(0),
+		Args:    flags.Args()[1:],
+	})
+	conn.Write(append(req, '\n'))
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read response:", err)
+		os.Exit(1)
+	}
+
+	var response map[string]json.RawMessage
+	var pretty bytes.Buffer
+	if err := json.Unmarshal(line, &response); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid response:", err)
+		os.Exit(1)
+	}
+	json.Indent(&pretty, line, "", "  ")
+	fmt.Print(pretty.String())
+
+	if _, failed := response["error"]; failed {
+		os.Exit(1)
+	}
+}
+
+// Returns whether we've been run as 'wsgo ctl'.
+func IsControlClient() bool {
+	return len(os.Args) > 1 && os.Args[1] == "ctl"
+}
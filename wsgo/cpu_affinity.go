@@ -0,0 +1,197 @@
+package wsgo
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The CPUs the worker threads of this process are pinned to (nil if they
+// aren't pinned).
+var workerCpuSet *unix.CPUSet
+
+// The most CPUs a CPUSet can hold.
+const maxCpus = len(unix.CPUSet{}) * 64
+
+// Parses a Linux-style CPU list, eg "0-3,8".
+func ParseCpuList(list string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, errors.New("invalid CPU list " + list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, errors.New("invalid CPU list " + list)
+			}
+		}
+		if last >= maxCpus {
+			return nil, errors.New("CPU " + strconv.Itoa(last) + " is beyond the highest supported (" + strconv.Itoa(maxCpus-1) + ")")
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+func ValidateCpuAffinity() error {
+	switch {
+	case cpuAffinity == "none", cpuAffinity == "per-process", cpuAffinity == "numa":
+		return nil
+	case strings.HasPrefix(cpuAffinity, "list:"):
+		cpus, err := ParseCpuList(strings.TrimPrefix(cpuAffinity, "list:"))
+		if err == nil && len(cpus) == 0 {
+			err = errors.New("empty CPU list")
+		}
+		return err
+	}
+	return errors.New("--cpu-affinity must be none, per-process, numa or list:<cpus>")
+}
+
+// Returns the CPUs of each NUMA node (just one node if there's no NUMA
+// information).
+func GetNumaNodes() [][]int {
+	paths, _ := filepath.Glob("/sys/devices/system/node/node*/cpulist")
+	sort.Slice(paths, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(filepath.Dir(paths[i])), "node"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(filepath.Dir(paths[j])), "node"))
+		return a < b
+	})
+
+	var nodes [][]int
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		cpus, err := ParseCpuList(string(b))
+		if err != nil || len(cpus) == 0 {
+			continue
+		}
+		nodes = append(nodes, cpus)
+	}
+	return nodes
+}
+
+// Filters cpus down to those we're allowed to run on.
+func allowedCpus(inherited *unix.CPUSet, cpus []int) []int {
+	var allowed []int
+	for _, cpu := range cpus {
+		if inherited.IsSet(cpu) {
+			allowed = append(allowed, cpu)
+		}
+	}
+	return allowed
+}
+
+// Returns the allowed CPUs, ordered so that consecutive processes alternate
+// between NUMA nodes.
+func spreadCpus(inherited *unix.CPUSet) []int {
+	var nodes [][]int
+	for _, node := range GetNumaNodes() {
+		if cpus := allowedCpus(inherited, node); len(cpus) > 0 {
+			nodes = append(nodes, cpus)
+		}
+	}
+
+	var cpus []int
+	for i := 0; ; i++ {
+		added := false
+		for _, node := range nodes {
+			if i < len(node) {
+				cpus = append(cpus, node[i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+
+	// Include any allowed CPUs that aren't in a known node
+	seen := make(map[int]bool)
+	for _, cpu := range cpus {
+		seen[cpu] = true
+	}
+	for cpu := 0; cpu < len(inherited)*64; cpu++ {
+		if inherited.IsSet(cpu) && !seen[cpu] {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus
+}
+
+// Works out which CPUs this process's worker threads should run on, within
+// the affinity mask we were started with.
+func InitCpuAffinity() {
+	if cpuAffinity == "none" {
+		return
+	}
+
+	var inherited unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &inherited); err != nil {
+		log.Println("Process", process, "couldn't get CPU affinity:", err)
+		return
+	}
+
+	var cpus []int
+	switch {
+	case cpuAffinity == "per-process":
+		// Pin all the threads to the same CPU, which should reduce the
+		// 'convoy problem' caused by the GIL.
+		spread := spreadCpus(&inherited)
+		if len(spread) > 0 {
+			cpus = []int{spread[(process-1)%len(spread)]}
+		}
+	case cpuAffinity == "numa":
+		// Keep each process (and its memory) on a single node.
+		var nodes [][]int
+		for _, node := range GetNumaNodes() {
+			if allowed := allowedCpus(&inherited, node); len(allowed) > 0 {
+				nodes = append(nodes, allowed)
+			}
+		}
+		if len(nodes) > 0 {
+			cpus = nodes[(process-1)%len(nodes)]
+		}
+	case strings.HasPrefix(cpuAffinity, "list:"):
+		list, _ := ParseCpuList(strings.TrimPrefix(cpuAffinity, "list:"))
+		cpus = allowedCpus(&inherited, list)
+		if len(cpus) == 0 {
+			ExitProcessInvalid("None of the CPUs in --cpu-affinity are available to this process")
+		}
+	}
+	if len(cpus) == 0 {
+		return
+	}
+
+	workerCpuSet = &unix.CPUSet{}
+	var names []string
+	for _, cpu := range cpus {
+		workerCpuSet.Set(cpu)
+		names = append(names, strconv.Itoa(cpu))
+	}
+	log.Println("Process", process, "pinning workers to CPU", strings.Join(names, ","))
+}
+
+// Pins the current thread according to the affinity policy. The caller should
+// have locked the goroutine to the thread.
+func PinWorkerThread() {
+	if workerCpuSet != nil {
+		unix.SchedSetaffinity(0, workerCpuSet)
+	}
+}
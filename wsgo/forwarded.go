@@ -0,0 +1,182 @@
+package wsgo
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Proxies whose forwarding headers we believe, from --trusted-proxy. When none
+// are given, loopback and private addresses are trusted.
+var trustedProxyNets []*net.IPNet
+
+// Parses the --trusted-proxy CIDRs (or single addresses).
+func ParseTrustedProxies() error {
+	trustedProxyNets = nil
+	for _, value := range trustedProxies {
+		cidr := value
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.New("invalid --trusted-proxy " + value)
+		}
+		trustedProxyNets = append(trustedProxyNets, ipNet)
+	}
+	return nil
+}
+
+func IsTrustedProxy(ip net.IP) bool {
+	if len(trustedProxies) == 0 {
+		return ip.IsLoopback() || ip.IsPrivate()
+	}
+	for _, ipNet := range trustedProxyNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// One hop of a request's journey through a chain of proxies: the address that
+// connected to a proxy (nil if unknown or obfuscated), and the scheme it used
+// (if given).
+type ForwardedHop struct {
+	ip    net.IP
+	proto string
+}
+
+// Parses a node from a Forwarded or X-Forwarded-For header, which may have a
+// port and (for IPv6) brackets.
+func parseForwardedNode(node string) net.IP {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end < 0 {
+			return nil
+		}
+		return net.ParseIP(node[1:end])
+	}
+	if ip := net.ParseIP(node); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// Splits a header value on sep, except within quoted strings.
+func splitQuoted(value string, sep rune) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i, r := range value {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == sep && !quoted:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// Returns the hops recorded by any proxies, from the client onwards, taken from
+// the RFC 7239 Forwarded header if present, or else X-Forwarded-For and
+// X-Forwarded-Proto.
+func ForwardedHops(req *http.Request) []ForwardedHop {
+	var hops []ForwardedHop
+
+	if forwarded := req.Header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range splitQuoted(strings.Join(forwarded, ","), ',') {
+			var hop ForwardedHop
+			for _, pair := range splitQuoted(element, ';') {
+				key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				switch strings.ToLower(key) {
+				case "for":
+					hop.ip = parseForwardedNode(value)
+				case "proto":
+					hop.proto = strings.ToLower(strings.Trim(value, `"`))
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return hops
+	}
+
+	var protos []string
+	if xfp := req.Header.Values("X-Forwarded-Proto"); len(xfp) > 0 {
+		for _, proto := range strings.Split(strings.Join(xfp, ","), ",") {
+			protos = append(protos, strings.ToLower(strings.TrimSpace(proto)))
+		}
+	}
+
+	if xff := req.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		for _, node := range strings.Split(strings.Join(xff, ","), ",") {
+			hops = append(hops, ForwardedHop{ip: parseForwardedNode(node)})
+		}
+	}
+
+	switch {
+	case len(protos) == 0:
+	case len(protos) == len(hops):
+		// Each proxy appended to both headers
+		for i := range hops {
+			hops[i].proto = protos[i]
+		}
+	case len(hops) == 0:
+		// Only the scheme was forwarded
+		hops = []ForwardedHop{{proto: protos[len(protos)-1]}}
+	default:
+		// Probably set by the nearest proxy
+		hops[len(hops)-1].proto = protos[len(protos)-1]
+	}
+
+	return hops
+}
+
+// Returns the client's address and the scheme it used (or "" if unknown).
+// Starting from the connection's peer, we follow the forwarding headers back
+// from right to left for as long as the address that added them is a trusted
+// proxy, so that a client can't spoof its address by sending the headers
+// itself. Requests over unix sockets are always from a trusted proxy.
+func ResolveClient(req *http.Request) (string, string) {
+	client := "-"
+	if !IsUnixSocketRequest(req) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return "-", ""
+		}
+		client = host
+		peer := net.ParseIP(host)
+		if peer == nil || !IsTrustedProxy(peer) {
+			return client, ""
+		}
+	}
+
+	scheme := ""
+	hops := ForwardedHops(req)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].proto != "" {
+			scheme = hops[i].proto
+		}
+		if hops[i].ip == nil {
+			// We can't tell who connected to the last trusted proxy
+			break
+		}
+		client = hops[i].ip.String()
+		if !IsTrustedProxy(hops[i].ip) {
+			break
+		}
+	}
+
+	return client, scheme
+}
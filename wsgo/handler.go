@@ -3,15 +3,15 @@ package wsgo
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-
-	"github.com/projecthunt/reuseable"
 )
 
 /*
@@ -29,6 +29,38 @@ var backgroundJobActive sync.Mutex
 
 var server *http.Server
 
+// Receives the reason for a requested restart.
+var restartRequests chan string = make(chan string, 1)
+var restartRequested atomic.Bool
+
+// Connections which have been accepted, but haven't started sending a request.
+var newConnections sync.Map
+
+func TrackNewConnections(conn net.Conn, state http.ConnState) {
+	if state == http.StateNew {
+		newConnections.Store(conn, true)
+	} else {
+		newConnections.Delete(conn)
+	}
+}
+
+// Waits (up to timeout) for every newly accepted connection to either start
+// sending its request or be closed.
+func WaitForNewConnections(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		empty := true
+		newConnections.Range(func(k, v any) bool {
+			empty = false
+			return false
+		})
+		if empty {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func init() {
 	backgroundJobs = make(chan *BackgroundJob, 0)
 }
@@ -42,7 +74,17 @@ func Serve(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	try_cache_status := TryCache(w, req)
+	if FindMount(req.URL.Path) == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	webSocket := IsWebSocketRequest(req)
+
+	try_cache_status := MISS
+	if !webSocket {
+		try_cache_status = TryCache(w, req)
+	}
 	if try_cache_status == HIT {
 		LogRequest(
 			req,
@@ -63,7 +105,7 @@ func Serve(w http.ResponseWriter, req *http.Request) {
 
 	var cw *CacheWriter
 
-	if maxAge > 0 && pageCacheLimit > 0 && (req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS") {
+	if maxAge > 0 && pageCacheLimit > 0 && !webSocket && (req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS") {
 		// We might be able to cache this
 		if alreadyResponded {
 			cw = NewCacheOnlyCacheWriter()
@@ -113,6 +155,11 @@ func Serve(w http.ResponseWriter, req *http.Request) {
 }
 
 func StartupWsgo(initMux func(*http.ServeMux)) {
+	if IsControlClient() {
+		RunControlClient(os.Args[2:])
+		return
+	}
+
 	ParseFlags()
 
 	if process == 0 {
@@ -120,17 +167,28 @@ func StartupWsgo(initMux func(*http.ServeMux)) {
 		return
 	}
 
-	listener, err := reuseable.Listen("tcp", bindAddress)
-	if err != nil {
-		log.Fatalln(err)
-	}
+	ApplyResourceLimits()
+	ConnectToManager()
+
+	listeners := OpenListeners()
 
-	InitPythonInterpreter(wsgiModule)
+	DropPrivileges()
+	ChangeDirectory()
+
+	InitPythonInterpreter()
+	if asgiMode {
+		StartAsgi()
+	}
 
 	StartWorkers()
 
 	go CronRoutine()
 	go NewMonitor()
+	go RecycleRoutine()
+	go HeartbeatRoutine()
+	if pyAutoreload {
+		go AutoreloadRoutine()
+	}
 
 	serverMux := http.NewServeMux()
 	serverMux.HandleFunc("/", Serve)
@@ -149,15 +207,35 @@ func StartupWsgo(initMux func(*http.ServeMux)) {
 		// Time to read the request header.
 		ReadHeaderTimeout: 2 * time.Second,
 		Handler:           serverMux,
+		ConnState:         TrackNewConnections,
+		Protocols:         ServerProtocols(),
 	}
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	shuttingDown := make(chan bool, 0)
 	go func() {
-        sig := <-sigs
-        log.Println("Process", process, "got", sig, "signal, shutting down...")
+		select {
+		case sig := <-sigs:
+			log.Println("Process", process, "got", sig, "signal, shutting down...")
+		case reason := <-restartRequests:
+			log.Println("Process", process, "restarting ("+reason+"), shutting down...")
+		}
+		NotifyManager(ProcessMessage{Type: "stopping"})
+
+		// Shutdown drops connections whose request arrives after it has been
+		// called, so stop accepting connections first and give any that have
+		// just been accepted a chance to send their request.
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		WaitForNewConnections(server.ReadHeaderTimeout)
+		StopStreamingResponses()
 		server.Shutdown(context.Background())
+		CloseWebSockets()
+		if asgiMode {
+			StopAsgi()
+		}
 
 		// grab the background job mutex, to wait on any currently running job
 		backgroundJobActive.Lock()
@@ -165,7 +243,14 @@ func StartupWsgo(initMux func(*http.ServeMux)) {
 		shuttingDown <- true
     }()
 
-	server.Serve(listener)
+	// Let the process manager know we're ready to take over from any
+	// process we're replacing.
+	NotifyManager(ProcessMessage{Type: "ready"})
+
+	for _, listener := range listeners[1:] {
+		go server.Serve(listener)
+	}
+	server.Serve(listeners[0])
 
 	shutdownTimedOut := false
 	select {
@@ -201,4 +286,17 @@ func StartupWsgo(initMux func(*http.ServeMux)) {
 	} else {
 		log.Println("Process", process, "shut down gracefully.")
 	}
+
+	if restartRequested.Load() {
+		os.Exit(EXITCODE_RESTART)
+	}
+}
+
+// Gracefully shuts this process down, exiting with EXITCODE_RESTART so that the
+// process manager replaces it straight away.
+func RestartProcess(reason string) {
+	if restartRequested.Swap(true) {
+		return
+	}
+	restartRequests <- reason
 }
@@ -0,0 +1,190 @@
+package wsgo
+
+import (
+	"log"
+	"math"
+	"syscall"
+	"time"
+)
+
+var HEARTBEAT_INTERVAL = 1 * time.Second
+
+// The state of a worker thread, as reported in heartbeats.
+type WorkerState struct {
+	Worker  int    `json:"worker"`
+	Busy    bool   `json:"busy"`
+	Stuck   bool   `json:"stuck,omitempty"`
+	Request string `json:"request,omitempty"`
+	Seconds int    `json:"seconds,omitempty"`
+}
+
+func GetWorkerStates() []WorkerState {
+	var states []WorkerState
+	now := time.Now()
+	for _, w := range workers {
+		state := WorkerState{
+			Worker: w.number,
+			Stuck:  w.stuck.Load(),
+		}
+		if job := w.activeJob.Load(); job != nil {
+			state.Busy = true
+			state.Request = job.req.Method + " " + job.req.RequestURI
+			state.Seconds = int(now.Sub(time.Unix(0, w.activeSince.Load())).Seconds())
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+func NewHeartbeat() ProcessMessage {
+	// Taking the scheduler lock means that if the Go side of the process is
+	// wedged, we'll stop heartbeating.
+	scheduler.jobQueueMutex.Lock()
+	queueLength := len(scheduler.jobQueue)
+	scheduler.jobQueueMutex.Unlock()
+
+	return ProcessMessage{
+		Type:           "heartbeat",
+		Workers:        GetWorkerStates(),
+		QueueLength:    queueLength,
+		ActiveRequests: int(scheduler.activeRequests.Load()),
+	}
+}
+
+// Periodically lets the process manager know we're still alive.
+func HeartbeatRoutine() {
+	if managerConn == nil {
+		return
+	}
+	for {
+		NotifyManager(NewHeartbeat())
+		time.Sleep(HEARTBEAT_INTERVAL)
+	}
+}
+
+// Totals from the most recent heartbeats of the current processes.
+type ProcessLoad struct {
+	processes int
+	// processes which have reported in recently
+	reporting int
+	workers   int
+	busy      int
+	stuck     int
+	queued    int
+	active    int
+}
+
+// Returns how many requests a process was handling or had queued, as of its
+// last heartbeat. A process which hasn't heartbeated recently counts as busier
+// than any that have.
+func (child *ChildProcess) Busyness() int {
+	child.mutex.Lock()
+	defer child.mutex.Unlock()
+	if time.Since(child.lastHeartbeatTime) >= 5*HEARTBEAT_INTERVAL {
+		return math.MaxInt
+	}
+	return child.lastHeartbeat.ActiveRequests + child.lastHeartbeat.QueueLength
+}
+
+func GetProcessLoad() ProcessLoad {
+	childProcessesMutex.Lock()
+	var children []*ChildProcess
+	for _, child := range childProcesses {
+		if child != nil {
+			children = append(children, child)
+		}
+	}
+	childProcessesMutex.Unlock()
+
+	load := ProcessLoad{processes: len(children)}
+	for _, child := range children {
+		child.mutex.Lock()
+		heartbeat := child.lastHeartbeat
+		fresh := time.Since(child.lastHeartbeatTime) < 5*HEARTBEAT_INTERVAL
+		child.mutex.Unlock()
+		if !fresh {
+			continue
+		}
+
+		load.reporting++
+		load.queued += heartbeat.QueueLength
+		load.active += heartbeat.ActiveRequests
+		for _, w := range heartbeat.Workers {
+			load.workers++
+			if w.Busy {
+				load.busy++
+			}
+			if w.Stuck {
+				load.stuck++
+			}
+		}
+	}
+	return load
+}
+
+func (child *ChildProcess) LogWorkerStates() {
+	child.mutex.Lock()
+	heartbeat := child.lastHeartbeat
+	child.mutex.Unlock()
+
+	if heartbeat.Type == "" {
+		log.Println("Process", child.number, "never reported its worker states.")
+		return
+	}
+
+	log.Println("Process", child.number, "last reported", heartbeat.QueueLength, "queued and", heartbeat.ActiveRequests, "active requests, with worker states:")
+	idle := 0
+	for _, w := range heartbeat.Workers {
+		if !w.Busy {
+			idle++
+			continue
+		}
+		stuck := ""
+		if w.Stuck {
+			stuck = " (stuck)"
+		}
+		log.Printf("  worker %d: busy for %ds with %s%s\n", w.Worker, w.Seconds, w.Request, stuck)
+	}
+	log.Printf("  %d idle workers\n", idle)
+}
+
+// Kills a child process if it stops heartbeating, or takes too long to shut
+// down, so that RunProcess will restart it.
+func (child *ChildProcess) MonitorHeartbeats() {
+	if heartbeatTimeout <= 0 {
+		return
+	}
+	timeout := time.Duration(heartbeatTimeout) * time.Second
+	// Enough time to finish requests and then finalize the interpreter.
+	shutdownTimeout := time.Duration(requestTimeout+15)*time.Second + timeout
+
+	for {
+		select {
+		case <-child.exited:
+			return
+		case <-time.After(HEARTBEAT_INTERVAL):
+		}
+
+		child.mutex.Lock()
+		lastHeartbeatTime := child.lastHeartbeatTime
+		stoppingSince := child.stoppingSince
+		child.mutex.Unlock()
+
+		if !stoppingSince.IsZero() {
+			if time.Since(stoppingSince) < shutdownTimeout {
+				continue
+			}
+			log.Println("Process", child.number, "didn't shut down within", shutdownTimeout, "- killing it.")
+		} else {
+			// Heartbeats only start once the application has been imported.
+			if lastHeartbeatTime.IsZero() || time.Since(lastHeartbeatTime) < timeout {
+				continue
+			}
+			log.Println("Process", child.number, "stopped heartbeating for", timeout, "- killing it.")
+		}
+
+		child.LogWorkerStates()
+		child.cmd.Process.Signal(syscall.SIGKILL)
+		return
+	}
+}
@@ -0,0 +1,36 @@
+package wsgo
+
+import (
+	"net/http"
+)
+
+// Returns the protocols to serve. With --http2, plain sockets also accept
+// HTTP/2 with prior knowledge (h2c), alongside HTTP/1.
+func ServerProtocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	if enableHTTP2 {
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return protocols
+}
+
+// Returns the protocols to offer via ALPN on HTTPS sockets, most preferred
+// first.
+func ALPNProtocols() []string {
+	if enableHTTP2 {
+		return []string{"h2", "http/1.1"}
+	}
+	return []string{"http/1.1"}
+}
+
+// Connection-specific response headers, which aren't allowed in HTTP/2 (and
+// which Go doesn't already drop itself).
+var connectionSpecificHeaders = []string{"Keep-Alive", "Proxy-Connection", "Upgrade"}
+
+// Returns whether a response header from the application has to be dropped
+// for this request.
+func IsConnectionSpecificHeader(req *http.Request, key string) bool {
+	return req.ProtoMajor >= 2 && contains(connectionSpecificHeaders, http.CanonicalHeaderKey(key))
+}
@@ -0,0 +1,352 @@
+package wsgo
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/projecthunt/reuseable"
+)
+
+// A listening socket inherited from the process manager, as fd:address.
+type inheritedSocket struct {
+	fd      uintptr
+	address string
+}
+
+type inheritedSockets []inheritedSocket
+
+func (i *inheritedSockets) String() string {
+	return "?"
+}
+
+func (i *inheritedSockets) Set(value string) error {
+	bits := strings.SplitN(value, ":", 2)
+	if len(bits) != 2 {
+		return errors.New("Usage: --inherited-socket <fd>:<address>")
+	}
+	fd, err := strconv.Atoi(bits[0])
+	if err != nil || fd < 3 {
+		return errors.New("Invalid inherited socket fd")
+	}
+	*i = append(*i, inheritedSocket{uintptr(fd), bits[1]})
+	return nil
+}
+
+func (i *inheritedSockets) Values() []string {
+	var ret []string
+	for _, s := range *i {
+		ret = append(ret, strconv.Itoa(int(s.fd))+":"+s.address)
+	}
+	return ret
+}
+
+// Listening sockets bound by the process manager, to be passed to each child.
+var managerListeners []net.Listener
+var managerListenerFiles []*os.File
+var managerListenerAddresses []string
+
+func IsUnixSocketAddress(address string) bool {
+	return strings.HasPrefix(address, "unix:")
+}
+
+// Removes a socket file left behind by a previous run, as long as nothing is
+// listening on it any more.
+func RemoveStaleSocket(path string) error {
+	if stat, err := os.Lstat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return fmt.Errorf("listen unix %s: address already in use", path)
+		}
+		os.Remove(path)
+	}
+	return nil
+}
+
+func ListenUnix(path string) (net.Listener, error) {
+	if err := RemoveStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if socketMode != "" {
+		mode, err := strconv.ParseUint(socketMode, 8, 32)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("invalid --socket-mode %s", socketMode)
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	if socketOwner != "" {
+		uid, gid, err := LookupOwner(socketOwner)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
+
+// Parses a user[:group] specification, returning the numeric uid and gid (or
+// -1 for either if not given).
+func LookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	bits := strings.SplitN(owner, ":", 2)
+
+	if bits[0] != "" {
+		u, err := user.Lookup(bits[0])
+		if err != nil {
+			u, err = user.LookupId(bits[0])
+		}
+		if err != nil {
+			return -1, -1, fmt.Errorf("unknown user %s", bits[0])
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	if len(bits) == 2 && bits[1] != "" {
+		var err error
+		gid, err = LookupGroup(bits[1])
+		if err != nil {
+			return -1, -1, err
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// Returns the numeric gid of a group given by name or number.
+func LookupGroup(group string) (int, error) {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		g, err = user.LookupGroupId(group)
+	}
+	if err != nil {
+		return -1, fmt.Errorf("unknown group %s", group)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+func Listen(address string) (net.Listener, error) {
+	if IsUnixSocketAddress(address) {
+		return ListenUnix(strings.TrimPrefix(address, "unix:"))
+	}
+	return reuseable.Listen("tcp", address)
+}
+
+// Returns every address to listen on, plain HTTP first and then HTTPS.
+func AllListenAddresses() []string {
+	return append(append([]string{}, bindAddresses...), httpsAddresses...)
+}
+
+// Binds any sockets which can't be bound by each child process separately
+// (ie, unix sockets, which don't support SO_REUSEPORT, or every socket with
+// --shared-socket), so that they can be shared with the children.
+func OpenManagerListeners() {
+	for _, address := range AllListenAddresses() {
+		if strings.HasPrefix(address, "systemd:") {
+			// already open
+			continue
+		}
+		if !IsUnixSocketAddress(address) && !sharedSocket {
+			continue
+		}
+
+		var listener net.Listener
+		var err error
+		if IsUnixSocketAddress(address) {
+			listener, err = Listen(address)
+		} else {
+			// No SO_REUSEPORT, as nobody else should be listening here.
+			listener, err = net.Listen("tcp", address)
+		}
+		if err != nil {
+			ExitProcessInvalid("Couldn't listen on " + address + ": " + err.Error())
+		}
+
+		f, err := listener.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			ExitProcessInvalid("Couldn't get file for " + address + ": " + err.Error())
+		}
+
+		managerListeners = append(managerListeners, listener)
+		managerListenerFiles = append(managerListenerFiles, f)
+		managerListenerAddresses = append(managerListenerAddresses, address)
+	}
+}
+
+// SO_REUSEPORT sockets bound by the process manager for each process slot,
+// for the TCP addresses that aren't shared. A replacement process inherits the
+// same sockets as the one it replaces, so any connections queued on them are
+// accepted by the new process, rather than being reset when the old process
+// closes its listener.
+var slotListenerFiles map[int][]*os.File = make(map[int][]*os.File)
+var slotListenersMutex sync.Mutex
+
+// Returns the addresses which are bound separately for each process slot.
+func SlotListenerAddresses() []string {
+	var addresses []string
+	for _, address := range AllListenAddresses() {
+		if strings.HasPrefix(address, "systemd:") || IsUnixSocketAddress(address) || sharedSocket {
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// Returns the listening sockets for a slot, binding them if they aren't
+// already open.
+func OpenSlotListeners(slot int) ([]*os.File, error) {
+	slotListenersMutex.Lock()
+	defer slotListenersMutex.Unlock()
+
+	if files, ok := slotListenerFiles[slot]; ok {
+		return files, nil
+	}
+
+	var files []*os.File
+	for _, address := range SlotListenerAddresses() {
+		listener, err := reuseable.Listen("tcp", address)
+		if err == nil {
+			var f *os.File
+			// (File returns a duplicate, which keeps the socket open)
+			f, err = listener.(interface{ File() (*os.File, error) }).File()
+			listener.Close()
+			files = append(files, f)
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("couldn't listen on %s: %v", address, err)
+		}
+	}
+
+	slotListenerFiles[slot] = files
+	return files, nil
+}
+
+// Closes a slot's listening sockets, once no process is going to take over
+// from the current one. Connections still queued on them are reset once that
+// process closes its own copy.
+func CloseSlotListeners(slot int) {
+	slotListenersMutex.Lock()
+	defer slotListenersMutex.Unlock()
+
+	for _, f := range slotListenerFiles[slot] {
+		f.Close()
+	}
+	delete(slotListenerFiles, slot)
+}
+
+// Returns the files to be inherited by a child in the given slot (to be the
+// first of its ExtraFiles), and the arguments telling it which fds they are on.
+func ChildListeners(slot int) ([]*os.File, []string, error) {
+	slotFiles, err := OpenSlotListeners(slot)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := append(append([]*os.File{}, managerListenerFiles...), slotFiles...)
+	addresses := append(append([]string{}, managerListenerAddresses...), SlotListenerAddresses()...)
+
+	var args []string
+	for i, address := range addresses {
+		args = append(args, "--inherited-socket="+strconv.Itoa(3+i)+":"+address)
+	}
+	return files, args, nil
+}
+
+func CloseManagerListeners() {
+	// Closing a unix listener also removes the socket file.
+	for _, listener := range managerListeners {
+		listener.Close()
+	}
+
+	CloseAllSlotListeners()
+}
+
+func CloseAllSlotListeners() {
+	slotListenersMutex.Lock()
+	defer slotListenersMutex.Unlock()
+
+	for slot, files := range slotListenerFiles {
+		for _, f := range files {
+			f.Close()
+		}
+		delete(slotListenerFiles, slot)
+	}
+}
+
+// Opens (or inherits) a listening socket for a child process.
+func OpenListener(address string) net.Listener {
+	var listener net.Listener
+	var err error
+
+	inherited := false
+	for _, s := range inheritedSocketList {
+		if s.address == address {
+			f := os.NewFile(s.fd, address)
+			listener, err = net.FileListener(f)
+			f.Close()
+			inherited = true
+			break
+		}
+	}
+	if !inherited {
+		listener, err = Listen(address)
+	}
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if UsesProxyProtocol(address) {
+		listener = &proxyProtocolListener{listener}
+	}
+	return listener
+}
+
+// Opens every listening socket for a child process, wrapping the HTTPS ones
+// with TLS.
+func OpenListeners() []net.Listener {
+	var listeners []net.Listener
+
+	for _, address := range bindAddresses {
+		listeners = append(listeners, OpenListener(address))
+	}
+
+	if len(httpsAddresses) > 0 {
+		if err := LoadCertificates(); err != nil {
+			ExitProcessInvalid("Couldn't load TLS certificates: " + err.Error())
+		}
+		tlsConfig := NewTLSConfig()
+		for _, address := range httpsAddresses {
+			listeners = append(listeners, tls.NewListener(OpenListener(address), tlsConfig))
+		}
+	}
+
+	return listeners
+}
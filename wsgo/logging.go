@@ -5,7 +5,6 @@ import (
 	"net"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -18,22 +17,15 @@ func firstNonEmpty(a string, b string, c string) string {
 	return c
 }
 
-func GetRemoteAddr(req *http.Request) string {
-	remoteAddr, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		return "-"
-	}
-
-	remoteAddrIp := net.ParseIP(remoteAddr)	
-	if remoteAddrIp != nil && (remoteAddrIp.IsLoopback() || remoteAddrIp.IsPrivate()) {
-		// only use X-F-F header if remoteAddr is local/private
-		f := strings.TrimSpace(strings.Split(req.Header.Get("X-Forwarded-For"), ",")[0])
-		if f != "" {
-			return f
-		}
-	}
+func IsUnixSocketRequest(req *http.Request) bool {
+	localAddr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && localAddr.Network() == "unix"
+}
 
-	return remoteAddr
+// Returns the address of the client, as reported by any trusted proxies.
+func GetRemoteAddr(req *http.Request) string {
+	client, _ := ResolveClient(req)
+	return client
 }
 
 func LogRequest(req *http.Request, statusCode int, finishTime time.Time, elapsed int, cpuTime int, workerNumber int, priority int) {
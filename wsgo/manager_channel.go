@@ -0,0 +1,107 @@
+package wsgo
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// A message passed between the process manager and a child process, sent as
+// one JSON object per line over a socketpair.
+type ProcessMessage struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason,omitempty"`
+
+	// heartbeat fields
+	Workers        []WorkerState `json:"workers,omitempty"`
+	QueueLength    int           `json:"queue_length,omitempty"`
+	ActiveRequests int           `json:"active_requests,omitempty"`
+
+	// scaling fields
+	MaxProcesses int `json:"max_processes,omitempty"`
+
+	// control command fields
+	ID      int             `json:"id,omitempty"`
+	Process int             `json:"process,omitempty"`
+	Command string          `json:"command,omitempty"`
+	Args    []string        `json:"args,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// The child's end of the channel to the process manager (nil if we weren't
+// started by one).
+var managerConn net.Conn
+var managerConnMutex sync.Mutex
+
+// Creates a connected pair of sockets, returning the manager's end as a
+// net.Conn and the child's end as a file to be inherited.
+func NewProcessChannel() (net.Conn, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	managerFile := os.NewFile(uintptr(fds[0]), "manager-channel")
+	conn, err := net.FileConn(managerFile)
+	managerFile.Close()
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+
+	return conn, os.NewFile(uintptr(fds[1]), "child-channel"), nil
+}
+
+func SendProcessMessage(conn net.Conn, msg ProcessMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(b, '\n'))
+	return err
+}
+
+// Calls handler for every message received on conn, until it is closed.
+func ReadProcessMessages(conn net.Conn, handler func(ProcessMessage)) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 65536), 16*1024*1024)
+	for scanner.Scan() {
+		var msg ProcessMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Println("Invalid process message:", err)
+			continue
+		}
+		handler(msg)
+	}
+}
+
+func ConnectToManager() {
+	if managerFd == 0 {
+		return
+	}
+	f := os.NewFile(uintptr(managerFd), "manager-channel")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		log.Fatalln("Couldn't connect to process manager:", err)
+	}
+	managerConn = conn
+	go ReadProcessMessages(conn, HandleManagerMessage)
+}
+
+// Sends a message to the process manager, if there is one.
+func NotifyManager(msg ProcessMessage) {
+	managerConnMutex.Lock()
+	defer managerConnMutex.Unlock()
+	if managerConn == nil {
+		return
+	}
+	if err := SendProcessMessage(managerConn, msg); err != nil {
+		log.Println("Process", process, "couldn't notify process manager:", err)
+	}
+}
@@ -0,0 +1,70 @@
+package wsgo
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+/*
+#include <Python.h>
+*/
+import "C"
+
+// A WSGI application served under a URL prefix.
+type Mount struct {
+	// with no trailing slash, so the root is ""
+	prefix string
+	spec   string
+	app    *C.PyObject
+}
+
+// Longest prefix first
+var mounts []*Mount
+
+// Parses the --mount options (or --module, if there aren't any).
+func ParseMounts() ([]*Mount, error) {
+	if len(mountSpecs) == 0 {
+		return []*Mount{{prefix: "", spec: wsgiModule}}, nil
+	}
+
+	var result []*Mount
+	seen := make(map[string]bool)
+	for _, v := range mountSpecs {
+		bits := strings.SplitN(v, "=", 2)
+		if len(bits) != 2 || !strings.HasPrefix(bits[0], "/") || bits[1] == "" {
+			return nil, errors.New("--mount must be given as /prefix=module:callable, not " + v)
+		}
+		prefix := strings.TrimRight(bits[0], "/")
+		if seen[prefix] {
+			return nil, errors.New("--mount prefix " + bits[0] + " given more than once")
+		}
+		seen[prefix] = true
+		result = append(result, &Mount{prefix: prefix, spec: bits[1]})
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return len(result[i].prefix) > len(result[j].prefix)
+	})
+	return result, nil
+}
+
+func ValidateMounts() error {
+	_, err := ParseMounts()
+	return err
+}
+
+// Returns the application to handle a path, or nil if there isn't one.
+func FindMount(path string) *Mount {
+	for _, m := range mounts {
+		if path == m.prefix || strings.HasPrefix(path, m.prefix+"/") {
+			return m
+		}
+	}
+	return nil
+}
+
+// Splits a request path into the SCRIPT_NAME and PATH_INFO for this mount.
+func (m *Mount) SplitPath(path string) (string, string) {
+	return m.prefix, path[len(m.prefix):]
+}
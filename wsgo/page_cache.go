@@ -253,6 +253,33 @@ func (entry *PageCacheEntry) Size() uint64 {
 	return 1000 + uint64(len(entry.buf))
 }
 
+// Removes every cached page whose URL starts with prefix, returning how many
+// were removed. A prefix starting with / matches the path on any host,
+// otherwise it should start with the host.
+func PurgeCache(prefix string) int {
+	pageCacheMutex.Lock()
+	defer pageCacheMutex.Unlock()
+
+	purged := 0
+	for k, entries := range pageCache {
+		url := k
+		if strings.HasPrefix(prefix, "/") {
+			if i := strings.Index(k, "/"); i >= 0 {
+				url = k[i:]
+			}
+		}
+		if !strings.HasPrefix(url, prefix) {
+			continue
+		}
+		for _, entry := range entries {
+			pageCacheSize -= entry.Size()
+		}
+		purged += len(entries)
+		delete(pageCache, k)
+	}
+	return purged
+}
+
 func PruneCache() {
 	pageCacheMutex.Lock()
 	// todo, make this not lock the map for the entire time
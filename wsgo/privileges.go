@@ -0,0 +1,148 @@
+package wsgo
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Works out the uid, gid and supplementary groups to run as. The gid and groups
+// default to those of the --uid user.
+func ResolvePrivileges() (int, int, []int, error) {
+	uid, gid := os.Getuid(), os.Getgid()
+	var groups []int
+	var u *user.User
+
+	if runAsUid != "" {
+		var err error
+		u, err = user.Lookup(runAsUid)
+		if err != nil {
+			u, err = user.LookupId(runAsUid)
+		}
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("unknown user %s", runAsUid)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+
+	if runAsGid != "" {
+		var err error
+		gid, err = LookupGroup(runAsGid)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+
+	if runAsGroups != "" {
+		for _, group := range strings.Split(runAsGroups, ",") {
+			g, err := LookupGroup(strings.TrimSpace(group))
+			if err != nil {
+				return 0, 0, nil, err
+			}
+			groups = append(groups, g)
+		}
+	} else if u != nil {
+		ids, err := u.GroupIds()
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("couldn't get groups of user %s: %s", u.Username, err)
+		}
+		for _, id := range ids {
+			g, _ := strconv.Atoi(id)
+			groups = append(groups, g)
+		}
+	}
+	if len(groups) == 0 {
+		groups = []int{gid}
+	}
+
+	return uid, gid, groups, nil
+}
+
+// Checks that we really are running as the given user and groups, and can't
+// get root back.
+func VerifyPrivileges(uid int, gid int, groups []int) error {
+	if os.Getuid() != uid || os.Geteuid() != uid {
+		return fmt.Errorf("uid is %d (effective %d), not %d", os.Getuid(), os.Geteuid(), uid)
+	}
+	if os.Getgid() != gid || os.Getegid() != gid {
+		return fmt.Errorf("gid is %d (effective %d), not %d", os.Getgid(), os.Getegid(), gid)
+	}
+
+	actual, err := os.Getgroups()
+	if err != nil {
+		return err
+	}
+	expected := append([]int{}, groups...)
+	sort.Ints(actual)
+	sort.Ints(expected)
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		return fmt.Errorf("groups are %v, not %v", actual, expected)
+	}
+
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("was able to regain root")
+	}
+	return nil
+}
+
+// Switches to the configured user, groups and chroot. This is done after
+// opening the listening sockets (so that privileged ports can be used) but
+// before importing the application. Exits if it doesn't fully succeed.
+func DropPrivileges() {
+	if runAsUid == "" && runAsGid == "" && runAsGroups == "" && chrootDir == "" {
+		return
+	}
+
+	// (look these up before the chroot hides /etc/passwd)
+	uid, gid, groups, err := ResolvePrivileges()
+	if err != nil {
+		ExitPrivilegesFailed("Couldn't drop privileges: " + err.Error())
+	}
+
+	if chrootDir != "" {
+		if err := syscall.Chroot(chrootDir); err != nil {
+			ExitPrivilegesFailed("Couldn't chroot to " + chrootDir + ": " + err.Error())
+		}
+		if err := os.Chdir("/"); err != nil {
+			ExitPrivilegesFailed("Couldn't chdir into chroot: " + err.Error())
+		}
+	}
+
+	// The Go runtime applies these to every thread.
+	if err := syscall.Setgroups(groups); err != nil {
+		ExitPrivilegesFailed("Couldn't set groups: " + err.Error())
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		ExitPrivilegesFailed("Couldn't set gid: " + err.Error())
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		ExitPrivilegesFailed("Couldn't set uid: " + err.Error())
+	}
+
+	if err := VerifyPrivileges(uid, gid, groups); err != nil {
+		ExitPrivilegesFailed("Privileges weren't fully dropped: " + err.Error())
+	}
+
+	log.Println("Process", process, "running as uid", uid, "gid", gid, "groups", groups)
+}
+
+// Exits a process which couldn't fully drop its privileges.
+func ExitPrivilegesFailed(msg string) {
+	log.Println(msg)
+	os.Exit(EXITCODE_PRIVILEGES)
+}
+
+// Stops every process when one couldn't drop its privileges (the rest would
+// fail the same way), so that the process manager exits with an error rather
+// than carrying on with nothing serving requests.
+func PrivilegesFailed() {
+	processManagerExitCode = EXITCODE_PRIVILEGES
+	StopChildProcesses()
+}
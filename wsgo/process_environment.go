@@ -0,0 +1,126 @@
+package wsgo
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns the environment for a child process: our own, plus the defaults and
+// --env variables, minus any --unset-env ones.
+func ChildEnvironment() []string {
+	env := append(
+		[]string{
+			// Stop glibc's per-thread arenas eating all the RAM, and
+			// encourage mmap use for allocations.
+			"GLIBC_TUNABLES=glibc.malloc.arena_max=2:glibc.malloc.mmap_threshold=250000",
+		},
+		// Inherit parent process environment
+		os.Environ()...,
+	)
+	env = append(env, childEnv...)
+
+	// Later values take precedence, so keep the last of each.
+	seen := make(map[string]bool)
+	var result []string
+	for i := len(env) - 1; i >= 0; i-- {
+		key := strings.SplitN(env[i], "=", 2)[0]
+		if seen[key] || contains(childUnsetEnv, key) {
+			continue
+		}
+		seen[key] = true
+		result = append([]string{env[i]}, result...)
+	}
+	return result
+}
+
+func ValidateChildEnvironment() error {
+	for _, v := range childEnv {
+		if !strings.Contains(v, "=") || strings.HasPrefix(v, "=") {
+			return errors.New("--env must be given as KEY=VALUE, not " + v)
+		}
+	}
+	return nil
+}
+
+type resourceLimit struct {
+	option   string
+	value    *string
+	resource int
+	// the units of the option value, in bytes
+	scale uint64
+}
+
+func resourceLimits() []resourceLimit {
+	return []resourceLimit{
+		{"limit-as", &limitAs, unix.RLIMIT_AS, 1024 * 1024},
+		{"limit-nofile", &limitNofile, unix.RLIMIT_NOFILE, 1},
+		{"limit-core", &limitCore, unix.RLIMIT_CORE, 1024 * 1024},
+	}
+}
+
+func parseResourceLimit(limit resourceLimit) (uint64, error) {
+	if *limit.value == "unlimited" {
+		return unix.RLIM_INFINITY, nil
+	}
+	n, err := strconv.ParseUint(*limit.value, 10, 64)
+	if err != nil {
+		return 0, errors.New("--" + limit.option + " must be a number or 'unlimited'")
+	}
+	return n * limit.scale, nil
+}
+
+func ValidateResourceLimits() error {
+	for _, limit := range resourceLimits() {
+		if *limit.value == "" {
+			continue
+		}
+		if _, err := parseResourceLimit(limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies the --limit-* options to this process. This is done first thing on
+// startup, so that the limits are in place before any listeners are opened or
+// the application is imported.
+func ApplyResourceLimits() {
+	for _, limit := range resourceLimits() {
+		if *limit.value == "" {
+			continue
+		}
+		n, _ := parseResourceLimit(limit)
+		rlimit := unix.Rlimit{Cur: n, Max: n}
+		if err := unix.Setrlimit(limit.resource, &rlimit); err != nil {
+			ExitProcessInvalid("Couldn't set --" + limit.option + ": " + err.Error())
+		}
+	}
+}
+
+// Kills anything left in a child's process group (eg, subprocesses started by
+// the application) once the child itself has exited.
+func KillProcessGroup(pid int) {
+	if !processGroup {
+		return
+	}
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err == nil {
+		log.Println("Killed leftover processes in process group", pid)
+	}
+}
+
+// Changes into the --chdir directory, after dropping privileges so that it is
+// relative to any chroot.
+func ChangeDirectory() {
+	if chdir == "" {
+		return
+	}
+	if err := os.Chdir(chdir); err != nil {
+		ExitProcessInvalid("Couldn't change directory: " + err.Error())
+	}
+}
@@ -2,84 +2,502 @@ package wsgo
 
 import (
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"sort"
 	"strconv"
 	"sync"
-    "syscall"
+	"syscall"
 	"time"
 )
 
 var EXITCODE_INVALID int = 27
+// Exited cleanly, but wants to be restarted straight away.
+var EXITCODE_RESTART int = 28
+// Couldn't switch to the configured user, so no process ever will.
+var EXITCODE_PRIVILEGES int = 29
+
+// How long a replacement process has to become ready during a rolling restart.
+var PROCESS_READY_TIMEOUT = 300 * time.Second
+
+type ChildProcess struct {
+	number int
+	cmd     *exec.Cmd
+	conn    net.Conn
+	started time.Time
+
+	// closed once the process reports it is serving requests
+	ready     chan bool
+	readyOnce sync.Once
+	// closed once the process has exited
+	exited chan bool
+
+	// set when another process has taken over this one's slot
+	replaced bool
+
+	mutex             sync.Mutex
+	lastHeartbeat     ProcessMessage
+	lastHeartbeatTime time.Time
+	// set once the process has started shutting down
+	stoppingSince     time.Time
+}
 
 var processManagerStopping bool = false
-var processCommands []*exec.Cmd
-var processCommandsMutex sync.Mutex
+// closed once the process manager starts stopping
+var processManagerStopped chan bool = make(chan bool)
+// The current process for each slot
+var childProcesses map[int]*ChildProcess = make(map[int]*ChildProcess)
+// Every process that is still running, including ones being replaced
+var runningChildProcesses map[*ChildProcess]bool = make(map[*ChildProcess]bool)
+// Slots which are being stopped for good, and won't be restarted
+var retiredSlots map[int]bool = make(map[int]bool)
+var childProcessesMutex sync.Mutex
+var processWaitGroup sync.WaitGroup
+var rollingRestartMutex sync.Mutex
+
+func (child *ChildProcess) HandleMessage(msg ProcessMessage) {
+	switch msg.Type {
+	case "ready":
+		child.readyOnce.Do(func() {
+			close(child.ready)
+		})
+	case "recycle":
+		go RecycleChildProcess(child, msg.Reason)
+	case "heartbeat":
+		child.mutex.Lock()
+		child.lastHeartbeat = msg
+		child.lastHeartbeatTime = time.Now()
+		child.mutex.Unlock()
+	case "stopping":
+		child.MarkStopping()
+	case "control-result":
+		HandleControlReply(msg)
+	}
+}
+
+func (child *ChildProcess) MarkStopping() {
+	child.mutex.Lock()
+	if child.stoppingSince.IsZero() {
+		child.stoppingSince = time.Now()
+	}
+	child.mutex.Unlock()
+}
+
+// Asks a child process to shut down gracefully.
+func (child *ChildProcess) Stop() {
+	child.MarkStopping()
+	child.cmd.Process.Signal(syscall.SIGTERM)
+}
 
-func RunProcess(wg *sync.WaitGroup, process int) {
+// Starts a new child process for the given slot, returning nil if the process
+// manager is stopping or the process couldn't be started.
+func StartChildProcess(process int) *ChildProcess {
+	conn, childFile, err := NewProcessChannel()
+	if err != nil {
+		log.Println("Couldn't create channel for process", process, err)
+		return nil
+	}
+	defer childFile.Close()
+
+	listenerFiles, listenerArgs, err := ChildListeners(process)
+	if err != nil {
+		log.Println("Process", process, "couldn't be started:", err)
+		conn.Close()
+		return nil
+	}
+
+	args := append(ChildArgs(), listenerArgs...)
+	args = append(args, ScalingArgs()...)
+	args = append(args,
+		"--manager-fd", strconv.Itoa(3+len(listenerFiles)),
+		"--process", strconv.Itoa(process),
+	)
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(listenerFiles, childFile)
+	cmd.Env = ChildEnvironment()
+	if processGroup {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	child := &ChildProcess{
+		number: process,
+		cmd:    cmd,
+		conn:   conn,
+		ready:  make(chan bool),
+		exited: make(chan bool),
+	}
+
+	childProcessesMutex.Lock()
+	defer childProcessesMutex.Unlock()
+
+	if processManagerStopping {
+		log.Println("Process", process, "not started.")
+		conn.Close()
+		return nil
+	}
+
+	if err := cmd.Start(); err != nil {
+		log.Println("Process", process, "couldn't be started:", err)
+		conn.Close()
+		return nil
+	}
+	child.started = time.Now()
+	runningChildProcesses[child] = true
+
+	go ReadProcessMessages(conn, child.HandleMessage)
+	go child.MonitorHeartbeats()
+	go func() {
+		cmd.Wait()
+		conn.Close()
+		KillProcessGroup(cmd.Process.Pid)
+
+		childProcessesMutex.Lock()
+		delete(runningChildProcesses, child)
+		childProcessesMutex.Unlock()
+
+		close(child.exited)
+	}()
+
+	return child
+}
+
+// Takes the lowest free slot and starts a process in it, returning the slot
+// number (or 0 if the process manager is stopping).
+func AddProcess() int {
+	childProcessesMutex.Lock()
+	defer childProcessesMutex.Unlock()
+
+	if processManagerStopping {
+		return 0
+	}
+	n := 1
 	for {
-		args := append(os.Args[1:], "--process", strconv.Itoa(process))
-		cmd := exec.Command(os.Args[0], args...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Env = append(
-			[]string{
-				// Stop glibc's per-thread arenas eating all the RAM, and
-				// encourage mmap use for allocations.
-				"GLIBC_TUNABLES=glibc.malloc.arena_max=2:glibc.malloc.mmap_threshold=250000",
-			},
-			// Inherit parent process environment
-			os.Environ()...,
-		)
-
-		processCommandsMutex.Lock()
-		processCommands = append(processCommands, cmd)
-		shouldExit := processManagerStopping
-		processCommandsMutex.Unlock()
-
-		if shouldExit {
-			log.Println("Process", process, "not started.")
+		if _, used := childProcesses[n]; !used {
+			break
+		}
+		n++
+	}
+	// Reserve the slot until RunProcess fills it in.
+	childProcesses[n] = nil
+
+	processWaitGroup.Add(1)
+	go RunProcess(n)
+	return n
+}
+
+// Gracefully stops the least busy process (by its last heartbeat), without
+// restarting it, preferring the highest numbered slot if there's a tie. The
+// first slot is never removed, as that runs the cron jobs.
+func RemoveProcess() int {
+	childProcessesMutex.Lock()
+	defer childProcessesMutex.Unlock()
+
+	n := 0
+	leastBusy := 0
+	for slot, child := range childProcesses {
+		if slot <= 1 || child == nil || retiredSlots[slot] {
+			continue
+		}
+		busy := child.Busyness()
+		if n == 0 || busy < leastBusy || (busy == leastBusy && slot > n) {
+			n = slot
+			leastBusy = busy
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	retiredSlots[n] = true
+	// Nothing will take over the slot's sockets, so let them close along with
+	// the process's own copies.
+	CloseSlotListeners(n)
+	childProcesses[n].Stop()
+	return n
+}
+
+// Returns the number of slots, not counting ones being retired.
+func ActiveProcessCount() int {
+	childProcessesMutex.Lock()
+	defer childProcessesMutex.Unlock()
+	return len(childProcesses) - len(retiredSlots)
+}
+
+func RunProcess(process int) {
+	defer processWaitGroup.Done()
+
+	child := StartChildProcess(process)
+	childProcessesMutex.Lock()
+	childProcesses[process] = child
+	childProcessesMutex.Unlock()
+
+	delay := RESTART_DELAY_MIN
+
+	for child != nil {
+		<-child.exited
+
+		childProcessesMutex.Lock()
+		replaced := child.replaced
+		if replaced {
+			// Another process has taken over the slot, so watch that instead
+			child = childProcesses[process]
+		}
+		retired := retiredSlots[process]
+		childProcessesMutex.Unlock()
+		if replaced {
+			continue
+		}
+		if child.cmd.ProcessState.ExitCode() != EXITCODE_RESTART {
+			// Don't leave connections queueing on the slot's sockets while
+			// nothing is accepting them (they'll be reopened on restart).
+			CloseSlotListeners(process)
+		}
+		if retired {
+			log.Println("Process", process, "has been retired.")
 			break
 		}
-		
-		cmd.Run()
 
-		if cmd.ProcessState.Success() {
+		if child.cmd.ProcessState.Success() {
 			log.Println("Process", process, "has finished.")
 			break
-		} else if cmd.ProcessState.ExitCode() == EXITCODE_INVALID {
+		} else if child.cmd.ProcessState.ExitCode() == EXITCODE_INVALID {
 			log.Println("Process", process, "could not start.")
+			childProcessesMutex.Lock()
+			processManagerExitCode = EXITCODE_INVALID
+			childProcessesMutex.Unlock()
+			break
+		} else if child.cmd.ProcessState.ExitCode() == EXITCODE_PRIVILEGES {
+			log.Println("Process", process, "could not drop privileges.")
+			PrivilegesFailed()
+			break
+		} else if child.cmd.ProcessState.ExitCode() == EXITCODE_RESTART {
+			log.Println("Process", process, "is restarting.")
+			child = StartChildProcess(process)
+			childProcessesMutex.Lock()
+			childProcesses[process] = child
+			childProcessesMutex.Unlock()
+			continue
+		}
+
+		// Only back off if the process keeps crashing soon after starting.
+		uptime := time.Since(child.started)
+		if uptime > time.Duration(crashWindow)*time.Second {
+			delay = RESTART_DELAY_MIN
+		}
+
+		crashes := RecordCrash()
+		log.Printf("Process %d exited uncleanly (%s) after %s, %d crashes in the last %ds.\n",
+			process, DescribeExit(child.cmd.ProcessState), uptime.Round(time.Millisecond), crashes, crashWindow)
+		if crashLimit > 0 && crashes > crashLimit {
+			CrashLoopDetected(crashes)
+			break
+		}
+
+		log.Println("Process", process, "restarting in", delay)
+		if !SleepUnlessStopping(delay) {
 			break
 		}
-		log.Println("Process", process, "exited uncleanly, restarting.")
-		time.Sleep(100 * time.Millisecond)
+		delay = NextRestartDelay(delay)
+
+		child = StartChildProcess(process)
+		childProcessesMutex.Lock()
+		childProcesses[process] = child
+		childProcessesMutex.Unlock()
+	}
+
+	childProcessesMutex.Lock()
+	if child == nil && !processManagerStopping {
+		// Don't let the process manager exit as if it had been stopped.
+		log.Println("Process", process, "couldn't be started, giving up.")
+		processManagerExitCode = EXITCODE_INVALID
 	}
-	wg.Done()
+	delete(childProcesses, process)
+	delete(retiredSlots, process)
+	childProcessesMutex.Unlock()
+	CloseSlotListeners(process)
+}
+
+// Starts a new process in the same slot as old, waits for it to be ready to
+// serve requests, and then gracefully stops the old one. If the new process
+// fails to become ready, the old one is left running.
+func ReplaceChildProcess(old *ChildProcess) bool {
+	replacement := StartChildProcess(old.number)
+	if replacement == nil {
+		return false
+	}
+
+	childProcessesMutex.Lock()
+	old.replaced = true
+	childProcesses[old.number] = replacement
+	childProcessesMutex.Unlock()
+
+	select {
+	case <-replacement.ready:
+		log.Println("Process", old.number, "replacement is ready, stopping old process.")
+		old.Stop()
+		<-old.exited
+		return true
+	case <-replacement.exited:
+		log.Println("Process", old.number, "replacement exited before becoming ready.")
+	case <-time.After(PROCESS_READY_TIMEOUT):
+		log.Println("Process", old.number, "replacement didn't become ready in time.")
+		replacement.cmd.Process.Kill()
+	}
+
+	childProcessesMutex.Lock()
+	select {
+	case <-old.exited:
+		// The old process has gone anyway, so leave the slot to the replacement
+		// (RunProcess will deal with it having exited).
+	default:
+		old.replaced = false
+		childProcesses[old.number] = old
+	}
+	childProcessesMutex.Unlock()
+	return false
+}
+
+// Replaces a child process which has hit one of its recycling limits.
+func RecycleChildProcess(child *ChildProcess, reason string) {
+	// Don't overlap with a rolling restart (which may replace it anyway).
+	rollingRestartMutex.Lock()
+	defer rollingRestartMutex.Unlock()
+
+	childProcessesMutex.Lock()
+	current := childProcesses[child.number] == child && !processManagerStopping && !retiredSlots[child.number]
+	childProcessesMutex.Unlock()
+	if !current {
+		return
+	}
+
+	log.Println("Process", child.number, "is being recycled ("+reason+").")
+	ReplaceChildProcess(child)
+}
+
+// Replaces each child process in turn, so that there are always processes
+// available to serve requests.
+func RollingRestart() {
+	if !rollingRestartMutex.TryLock() {
+		log.Println("Rolling restart already in progress.")
+		return
+	}
+	defer rollingRestartMutex.Unlock()
+
+	log.Println("Starting rolling restart.")
+	SdNotify("RELOADING=1")
+	// (whether or not the restart succeeds, we're still serving requests)
+	defer SdNotify("READY=1")
+
+	childProcessesMutex.Lock()
+	var numbers []int
+	for n := range childProcesses {
+		numbers = append(numbers, n)
+	}
+	childProcessesMutex.Unlock()
+	sort.Ints(numbers)
+
+	for _, n := range numbers {
+		childProcessesMutex.Lock()
+		old := childProcesses[n]
+		stopping := processManagerStopping
+		childProcessesMutex.Unlock()
+
+		if stopping {
+			return
+		}
+		if old == nil {
+			continue
+		}
+		if !ReplaceChildProcess(old) {
+			log.Println("Rolling restart aborted.")
+			return
+		}
+	}
+
+	log.Println("Rolling restart complete.")
 }
 
 func RunProcessManager() {
-	var wg sync.WaitGroup
+	InitSystemdNotify()
+	OpenSystemdListeners()
+	OpenManagerListeners()
+	defer CloseManagerListeners()
+	RunControlSocket()
+	defer CloseControlSocket()
 
+	InitScaling()
+	// Check the addresses can be bound before starting any processes.
+	if _, err := OpenSlotListeners(1); err != nil {
+		ExitProcessInvalid(err.Error())
+	}
 	for i := 1; i <= processes; i++ {
-		wg.Add(1)
-		go RunProcess(&wg, i)
+		AddProcess()
 	}
 
+	go SystemdNotifyRoutine()
+	go ScalingRoutine()
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-        <- sigs
-		processCommandsMutex.Lock()
-		processManagerStopping = true
-		defer processCommandsMutex.Unlock()
+		<-sigs
+		StopChildProcesses()
+	}()
 
-		for _, cmd := range processCommands {
-			cmd.Process.Signal(syscall.SIGTERM)
+	// SIGHUP restarts the processes one at a time, to pick up new code (or
+	// TLS certificates) without any downtime.
+	hupSigs := make(chan os.Signal, 1)
+	signal.Notify(hupSigs, syscall.SIGHUP)
+	go func() {
+		for {
+			<-hupSigs
+			go RollingRestart()
+		}
+	}()
+
+	// SIGTTIN and SIGTTOU add or remove a process.
+	ttinSigs := make(chan os.Signal, 1)
+	signal.Notify(ttinSigs, syscall.SIGTTIN, syscall.SIGTTOU)
+	go func() {
+		for {
+			if <-ttinSigs == syscall.SIGTTIN {
+				go ManuallyAddProcess()
+			} else {
+				go ManuallyRemoveProcess()
+			}
 		}
-    }()
+	}()
 
-	wg.Wait()
+	processWaitGroup.Wait()
+
+	if processManagerExitCode != 0 {
+		CloseManagerListeners()
+		CloseControlSocket()
+		os.Exit(processManagerExitCode)
+	}
+}
+
+// Gracefully stops every child process, without restarting them.
+func StopChildProcesses() {
+	childProcessesMutex.Lock()
+	defer childProcessesMutex.Unlock()
+
+	if processManagerStopping {
+		return
+	}
+	processManagerStopping = true
+	close(processManagerStopped)
+	SdNotify("STOPPING=1")
+
+	// The processes' own copies of their sockets are then the last ones open.
+	CloseAllSlotListeners()
+
+	for child := range runningChildProcesses {
+		child.Stop()
+	}
 }
 
 // Allow a process to exit without being restarted by the process manager.
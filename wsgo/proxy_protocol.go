@@ -0,0 +1,255 @@
+package wsgo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a client has to send its PROXY protocol header.
+var PROXY_PROTOCOL_TIMEOUT = 5 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest possible v1 header, including the CRLF.
+const PROXY_PROTOCOL_V1_MAX_LENGTH = 107
+
+// Returns whether connections to a listening address start with a PROXY
+// protocol header. Socket-activated addresses (systemd:<fd>:<name>) can be
+// given as systemd:<name>, since the fd isn't known in advance.
+func UsesProxyProtocol(address string) bool {
+	for _, a := range proxyProtocolAddresses {
+		if a == address {
+			return true
+		}
+		if name, ok := strings.CutPrefix(a, "systemd:"); ok && strings.HasPrefix(address, "systemd:") && strings.HasSuffix(address, ":"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func ValidateProxyProtocol() error {
+	for _, a := range proxyProtocolAddresses {
+		if !strings.HasPrefix(a, "systemd:") && !contains(AllListenAddresses(), a) {
+			return errors.New("--proxy-protocol " + a + " isn't one of the listening addresses")
+		}
+	}
+	return nil
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn}, nil
+}
+
+// A connection which starts with a PROXY protocol header, giving the address
+// of the client (and the address it connected to) in place of the load
+// balancer's. The header is read on first use, rather than when the connection
+// is accepted, so that a slow client can't hold up the others.
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	headerOnce sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+
+	// The read deadline set by the server, which is put back once the header
+	// has been read under its own deadline.
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+	headerRead    bool
+}
+
+func (c *proxyProtocolConn) readHeader() error {
+	c.headerOnce.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+
+		c.deadlineMutex.Lock()
+		deadline := time.Now().Add(PROXY_PROTOCOL_TIMEOUT)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+			deadline = c.readDeadline
+		}
+		c.deadlineMutex.Unlock()
+
+		c.Conn.SetReadDeadline(deadline)
+		c.remoteAddr, c.localAddr, c.err = ReadProxyProtocolHeader(c.reader)
+
+		c.deadlineMutex.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.headerRead = true
+		c.deadlineMutex.Unlock()
+
+		if c.err != nil {
+			log.Println("Process", process, "dropping connection from", c.Conn.RemoteAddr(), "with invalid PROXY protocol header:", c.err)
+			c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.readDeadline = t
+	if !c.headerRead {
+		// Applied once the header has been read
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Lets X-Sendfile responses still use sendfile on the underlying connection.
+func (c *proxyProtocolConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+// Reads a v1 (text) or v2 (binary) PROXY protocol header, returning the source
+// and destination addresses. These are nil if the header doesn't give them
+// (such as for health checks from the load balancer itself), in which case the
+// connection's own addresses should be used.
+func ReadProxyProtocolHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	signature, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	}
+	if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return readProxyProtocolV1(r)
+	}
+	return nil, nil, errors.New("missing header")
+}
+
+// eg "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= PROXY_PROTOCOL_V1_MAX_LENGTH {
+			return nil, nil, errors.New("v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New("invalid v1 header")
+	}
+
+	src := net.ParseIP(fields[2])
+	dst := net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || srcErr != nil || dstErr != nil {
+		return nil, nil, errors.New("invalid v1 address")
+	}
+	if (src.To4() != nil) != (fields[1] == "TCP4") || (dst.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, nil, errors.New("v1 address doesn't match protocol")
+	}
+
+	return &net.TCPAddr{IP: src, Port: int(srcPort)}, &net.TCPAddr{IP: dst, Port: int(dstPort)}, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	version := header[12] >> 4
+	command := header[12] & 0xf
+	family := header[13]
+
+	// The addresses are followed by optional TLVs, which we skip.
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if version != 2 {
+		return nil, nil, errors.New("unsupported version " + strconv.Itoa(int(version)))
+	}
+	switch command {
+	case 0x0:
+		// LOCAL, ie sent by the load balancer itself
+		return nil, nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, nil, errors.New("unsupported v2 command " + strconv.Itoa(int(command)))
+	}
+
+	var ipLength int
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		ipLength = 4
+	case 0x21:
+		// TCP over IPv6
+		ipLength = 16
+	default:
+		// UDP and unix sockets don't have a useful client address
+		return nil, nil, nil
+	}
+
+	if len(payload) < ipLength*2+4 {
+		return nil, nil, errors.New("v2 address too short")
+	}
+	src := net.IP(payload[0:ipLength])
+	dst := net.IP(payload[ipLength : ipLength*2])
+	srcPort := binary.BigEndian.Uint16(payload[ipLength*2:])
+	dstPort := binary.BigEndian.Uint16(payload[ipLength*2+2:])
+
+	return &net.TCPAddr{IP: src, Port: int(srcPort)}, &net.TCPAddr{IP: dst, Port: int(dstPort)}, nil
+}
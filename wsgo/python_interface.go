@@ -2,10 +2,12 @@ package wsgo
 
 import (
 	"errors"
-	"io"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"unsafe"
 )
 
@@ -20,12 +22,26 @@ int _PyIter_Check(PyObject *o) {
 	return PyIter_Check(o);
 }
 
+// Lists and tuples of chunks are already complete, so there's nothing to stream
+int _IsSequenceResponse(PyObject *o) {
+	return PyList_Check(o) || PyTuple_Check(o);
+}
+
 
 extern void go_wsgi_start_response(long request_id, const char* status, int status_len, const char** header_parts, int* header_part_lengths, int headers_size);
 extern PyObject *go_wsgi_read_request(long request_id, long to_read);
 extern PyObject *go_wsgi_read_request_line(long request_id);
 extern void go_add_cron(PyObject *func, long period, long min, long hour, long day, long mon, long wday);
 extern void go_notify_parked(const char* parked_id, int parked_id_len, int action, const char* param, int param_len);
+extern PyObject *go_websocket_accept(long request_id, const char* protocol, int protocol_len, double idle_timeout);
+extern PyObject *go_websocket_receive(long request_id, double timeout);
+extern PyObject *go_websocket_send(long request_id, int opcode, const char* data, Py_ssize_t data_len);
+extern PyObject *go_websocket_close(long request_id, int code, const char* reason, int reason_len);
+extern PyObject *go_websocket_status(long request_id);
+extern PyObject *go_asgi_start(long request_id, int status, const char** header_parts, Py_ssize_t* header_part_lengths, int headers_size);
+extern PyObject *go_asgi_write(long request_id, const char* data, Py_ssize_t data_len, int more_body);
+extern PyObject *go_asgi_wait_disconnect(long request_id);
+extern PyObject *go_asgi_finish(long request_id);
 
 
 // _PyCFunctionFast signature
@@ -232,9 +248,255 @@ static PyObject* wsgo_notify_parked(PyObject *self, PyObject **args, Py_ssize_t
 	return Py_None;
 }
 
+// _PyCFunctionFast signature: (request_id, protocol or None, idle_timeout or None)
+static PyObject* wsgo_websocket_accept(PyObject *self, PyObject **args, Py_ssize_t nargs)
+{
+	if(nargs!=3) {
+		PyErr_SetString(PyExc_TypeError, "expected 3 arguments");
+		return NULL;
+	}
+
+	long request_id = PyLong_AsLong(args[0]);
+	if(request_id==-1 && PyErr_Occurred()) {
+		return NULL;
+	}
+
+	const char *protocol = NULL;
+	Py_ssize_t protocol_len = 0;
+	if(args[1]!=Py_None) {
+		protocol = PyUnicode_AsUTF8AndSize(args[1], &protocol_len);
+		if(protocol==NULL) {
+			return NULL;
+		}
+	}
+
+	double idle_timeout = -1;
+	if(args[2]!=Py_None) {
+		idle_timeout = PyFloat_AsDouble(args[2]);
+		if(idle_timeout==-1 && PyErr_Occurred()) {
+			return NULL;
+		}
+	}
+
+	return go_websocket_accept(request_id, protocol, (int)protocol_len, idle_timeout);
+}
+
+// _PyCFunctionFast signature: (request_id, timeout), with a negative timeout
+// waiting forever
+static PyObject* wsgo_websocket_receive(PyObject *self, PyObject **args, Py_ssize_t nargs)
+{
+	if(nargs!=2) {
+		PyErr_SetString(PyExc_TypeError, "expected 2 arguments");
+		return NULL;
+	}
+
+	long request_id = PyLong_AsLong(args[0]);
+	double timeout = PyFloat_AsDouble(args[1]);
+	if(PyErr_Occurred()) {
+		return NULL;
+	}
+
+	return go_websocket_receive(request_id, timeout);
+}
+
+// _PyCFunctionFast signature: (request_id, data, is_ping), sending str as a
+// text message and anything bytes-like as a binary one
+static PyObject* wsgo_websocket_send(PyObject *self, PyObject **args, Py_ssize_t nargs)
+{
+	if(nargs!=3) {
+		PyErr_SetString(PyExc_TypeError, "expected 3 arguments");
+		return NULL;
+	}
+
+	long request_id = PyLong_AsLong(args[0]);
+	if(request_id==-1 && PyErr_Occurred()) {
+		return NULL;
+	}
+	int is_ping = PyObject_IsTrue(args[2]);
+
+	if(PyUnicode_Check(args[1])) {
+		Py_ssize_t data_len;
+		const char *data = PyUnicode_AsUTF8AndSize(args[1], &data_len);
+		if(data==NULL) {
+			return NULL;
+		}
+		return go_websocket_send(request_id, is_ping ? 0x9 : 0x1, data, data_len);
+	}
+
+	Py_buffer view;
+	if(PyObject_GetBuffer(args[1], &view, PyBUF_SIMPLE)!=0) {
+		return NULL;
+	}
+	PyObject *ret = go_websocket_send(request_id, is_ping ? 0x9 : 0x2, view.buf, view.len);
+	PyBuffer_Release(&view);
+	return ret;
+}
+
+// _PyCFunctionFast signature: (request_id, code, reason)
+static PyObject* wsgo_websocket_close(PyObject *self, PyObject **args, Py_ssize_t nargs)
+{
+	if(nargs!=3) {
+		PyErr_SetString(PyExc_TypeError, "expected 3 arguments");
+		return NULL;
+	}
+
+	long request_id = PyLong_AsLong(args[0]);
+	long code = PyLong_AsLong(args[1]);
+	if(PyErr_Occurred()) {
+		return NULL;
+	}
+
+	Py_ssize_t reason_len;
+	const char *reason = PyUnicode_AsUTF8AndSize(args[2], &reason_len);
+	if(reason==NULL) {
+		return NULL;
+	}
+
+	return go_websocket_close(request_id, (int)code, reason, (int)reason_len);
+}
+
+// _PyCFunctionFast signature: (request_id)
+static PyObject* wsgo_websocket_status(PyObject *self, PyObject **args, Py_ssize_t nargs)
+{
+	if(nargs!=1) {
+		PyErr_SetString(PyExc_TypeError, "expected 1 argument");
+		return NULL;
+	}
+
+	long request_id = PyLong_AsLong(args[0]);
+	if(request_id==-1 && PyErr_Occurred()) {
+		return NULL;
+	}
+
+	return go_websocket_status(request_id);
+}
+
+// _PyCFunctionFast signature: (request_id, status, headers), with headers an
+// iterable of [name, value] byte string pairs
+static PyObject* wsgo_asgi_start(PyObject *self, PyObject **args, Py_ssize_t nargs)
+{
+	if(nargs!=3) {
+		PyErr_SetString(PyExc_TypeError, "expected 3 arguments");
+		return NULL;
+	}
+
+	long request_id = PyLong_AsLong(args[0]);
+	long status = PyLong_AsLong(args[1]);
+	if(PyErr_Occurred()) {
+		return NULL;
+	}
+
+	PyObject *headers = PySequence_Fast(args[2], "headers must be iterable");
+	if(headers==NULL) {
+		return NULL;
+	}
+
+	Py_ssize_t headers_size = PySequence_Fast_GET_SIZE(headers);
+	PyObject **pairs = PyMem_Calloc(headers_size+1, sizeof(PyObject*));
+	const char **header_parts = PyMem_Calloc(headers_size*2+1, sizeof(char*));
+	Py_ssize_t *header_part_lengths = PyMem_Calloc(headers_size*2+1, sizeof(Py_ssize_t));
+	PyObject *ret = NULL;
+
+	for(Py_ssize_t i=0; i<headers_size; i++) {
+		// The pairs keep the byte strings alive until we're done with them
+		pairs[i] = PySequence_Fast(PySequence_Fast_GET_ITEM(headers, i), "header must be a [name, value] pair");
+		if(pairs[i]==NULL) {
+			goto done;
+		}
+		if(PySequence_Fast_GET_SIZE(pairs[i])!=2) {
+			PyErr_SetString(PyExc_ValueError, "header must be a [name, value] pair");
+			goto done;
+		}
+
+		char *part;
+		for(int j=0; j<2; j++) {
+			if(PyBytes_AsStringAndSize(PySequence_Fast_GET_ITEM(pairs[i], j), &part, &header_part_lengths[i*2+j])==-1) {
+				goto done;
+			}
+			header_parts[i*2+j] = part;
+		}
+	}
+
+	ret = go_asgi_start(request_id, (int)status, header_parts, header_part_lengths, (int)headers_size);
+
+done:
+	for(Py_ssize_t i=0; i<headers_size; i++) {
+		Py_XDECREF(pairs[i]);
+	}
+	PyMem_Free(pairs);
+	PyMem_Free(header_parts);
+	PyMem_Free(header_part_lengths);
+	Py_DECREF(headers);
+	return ret;
+}
+
+// _PyCFunctionFast signature: (request_id, body, more_body)
+static PyObject* wsgo_asgi_write(PyObject *self, PyObject **args, Py_ssize_t nargs)
+{
+	if(nargs!=3) {
+		PyErr_SetString(PyExc_TypeError, "expected 3 arguments");
+		return NULL;
+	}
+
+	long request_id = PyLong_AsLong(args[0]);
+	if(request_id==-1 && PyErr_Occurred()) {
+		return NULL;
+	}
+	int more_body = PyObject_IsTrue(args[2]);
+
+	Py_buffer view;
+	if(PyObject_GetBuffer(args[1], &view, PyBUF_SIMPLE)!=0) {
+		return NULL;
+	}
+	PyObject *ret = go_asgi_write(request_id, view.buf, view.len, more_body);
+	PyBuffer_Release(&view);
+	return ret;
+}
+
+// _PyCFunctionFast signature: (request_id)
+static PyObject* wsgo_asgi_wait_disconnect(PyObject *self, PyObject **args, Py_ssize_t nargs)
+{
+	if(nargs!=1) {
+		PyErr_SetString(PyExc_TypeError, "expected 1 argument");
+		return NULL;
+	}
+
+	long request_id = PyLong_AsLong(args[0]);
+	if(request_id==-1 && PyErr_Occurred()) {
+		return NULL;
+	}
+
+	return go_asgi_wait_disconnect(request_id);
+}
+
+// _PyCFunctionFast signature: (request_id)
+static PyObject* wsgo_asgi_finish(PyObject *self, PyObject **args, Py_ssize_t nargs)
+{
+	if(nargs!=1) {
+		PyErr_SetString(PyExc_TypeError, "expected 1 argument");
+		return NULL;
+	}
+
+	long request_id = PyLong_AsLong(args[0]);
+	if(request_id==-1 && PyErr_Occurred()) {
+		return NULL;
+	}
+
+	return go_asgi_finish(request_id);
+}
+
 static PyMethodDef WsgoMethods[] = {
 	{"add_cron", (PyCFunction)wsgo_add_cron, METH_FASTCALL, "Registers a cron handler"},
 	{"notify_parked", (PyCFunction)wsgo_notify_parked, METH_FASTCALL, "Notifies a parked job"},
+	{"_websocket_accept", (PyCFunction)wsgo_websocket_accept, METH_FASTCALL, "Accepts a WebSocket request"},
+	{"_websocket_receive", (PyCFunction)wsgo_websocket_receive, METH_FASTCALL, "Receives a WebSocket message"},
+	{"_websocket_send", (PyCFunction)wsgo_websocket_send, METH_FASTCALL, "Sends a WebSocket message or ping"},
+	{"_websocket_close", (PyCFunction)wsgo_websocket_close, METH_FASTCALL, "Closes a WebSocket"},
+	{"_websocket_status", (PyCFunction)wsgo_websocket_status, METH_FASTCALL, "Returns a WebSocket's close code and reason"},
+	{"_asgi_start", (PyCFunction)wsgo_asgi_start, METH_FASTCALL, "Starts an ASGI response"},
+	{"_asgi_write", (PyCFunction)wsgo_asgi_write, METH_FASTCALL, "Writes part of an ASGI response body"},
+	{"_asgi_wait_disconnect", (PyCFunction)wsgo_asgi_wait_disconnect, METH_FASTCALL, "Waits until an ASGI request is over"},
+	{"_asgi_finish", (PyCFunction)wsgo_asgi_finish, METH_FASTCALL, "Marks an ASGI request as finished"},
 	{NULL, NULL, 0, NULL}
 };
 
@@ -252,12 +514,22 @@ void register_wsgo_module() {
 	PyImport_AppendInittab("wsgo", &PyInit_wsgo);
 }
 
-void initialise_python() {
+// The program name (if given) is used to locate the standard library and
+// site-packages, so pointing it at a virtualenv's python selects that
+// virtualenv, as if it had been run directly. The home (if given) is the
+// prefix of the Python installation the virtualenv was created from.
+void initialise_python(char *program_name, char *home) {
 
 #if PY_VERSION_HEX < 0x03080000
 
 	// Before Python 3.8.0
 	Py_UnbufferedStdioFlag = 1;
+	if (program_name) {
+		Py_SetProgramName(Py_DecodeLocale(program_name, NULL));
+	}
+	if (home) {
+		Py_SetPythonHome(Py_DecodeLocale(home, NULL));
+	}
 	Py_Initialize();
 
 #else
@@ -268,6 +540,21 @@ void initialise_python() {
 	PyConfig_InitPythonConfig(&config);
 	config.buffered_stdio = 0;
 
+	if (program_name) {
+		status = PyConfig_SetBytesString(&config, &config.program_name, program_name);
+		if (PyStatus_Exception(status)) {
+			PyConfig_Clear(&config);
+			Py_ExitStatusException(status);
+		}
+	}
+	if (home) {
+		status = PyConfig_SetBytesString(&config, &config.home, home);
+		if (PyStatus_Exception(status)) {
+			PyConfig_Clear(&config);
+			Py_ExitStatusException(status);
+		}
+	}
+
 	status = Py_InitializeFromConfig(&config);
 	if (PyStatus_Exception(status)) {
 		PyConfig_Clear(&config);
@@ -290,7 +577,6 @@ uint64_t get_thread_cpu_time() {
 */
 import "C"
 
-var app_func *C.PyObject
 var start_response_def C.PyMethodDef
 
 func CreateStartResponseFunction(requestId int64) *C.PyObject {
@@ -302,17 +588,28 @@ func CreateStartResponseFunction(requestId int64) *C.PyObject {
 
 // Calls the WSGI application function. Returns a new reference to the output.
 func CallApplication(requestId int64, req *http.Request) *C.PyObject {
+	mount := FindMount(req.URL.Path)
+
 	app_func_args := C.PyTuple_New(2)
-	C.PyTuple_SetItem(app_func_args, 0, CreateWsgiEnvironment(requestId, req))  //steals
-	C.PyTuple_SetItem(app_func_args, 1, CreateStartResponseFunction(requestId)) //steals
+	C.PyTuple_SetItem(app_func_args, 0, CreateWsgiEnvironment(requestId, req, mount)) //steals
+	C.PyTuple_SetItem(app_func_args, 1, CreateStartResponseFunction(requestId))       //steals
 
-	ret := C.PyObject_CallObject(app_func, app_func_args)
+	ret := C.PyObject_CallObject(mount.app, app_func_args)
 	C.Py_DecRef(app_func_args)
 
 	return ret
 }
 
-func ReadWsgiResponseToWriter(response *C.PyObject, w io.Writer) error {
+// Returns whether a response is produced chunk by chunk, such as by a
+// generator, as opposed to already being complete.
+func IsIncrementalResponse(response *C.PyObject) bool {
+	return C._IsSequenceResponse(response) == 0
+}
+
+// Writes out each chunk of the response. When streaming, each chunk is sent on
+// to the client straight away, and the response is cut short if the process is
+// shutting down.
+func ReadWsgiResponseToWriter(response *C.PyObject, w *CacheWriter, streaming bool) error {
 	iter := C.PyObject_GetIter(response)
 	defer C.Py_DecRef(iter)
 
@@ -327,8 +624,17 @@ func ReadWsgiResponseToWriter(response *C.PyObject, w io.Writer) error {
 	}
 
 	for {
+		if streaming && StreamingResponsesStopped() {
+			log.Println("Process", process, "ending streamed response for shutdown")
+			break
+		}
+
 		item := C.PyIter_Next(iter)
 		if item == nil {
+			if C.PyErr_Occurred() != nil {
+				// Such as being interrupted by a timeout
+				C.PyErr_Print()
+			}
 			break
 		}
 		defer C.Py_DecRef(item)
@@ -352,6 +658,9 @@ func ReadWsgiResponseToWriter(response *C.PyObject, w io.Writer) error {
 		C.PyEval_SaveThread()
 
 		n, err := w.Write(v)
+		if err == nil && streaming {
+			err = w.FlushToClient()
+		}
 
 		// Regrab the GIL
 		C.PyEval_RestoreThread(gilState)
@@ -366,7 +675,13 @@ func ReadWsgiResponseToWriter(response *C.PyObject, w io.Writer) error {
 		}
 	}
 
-	// We must call .close() on the response if present
+	CloseWsgiResponse(response)
+
+	return nil
+}
+
+// Calls .close() on the response, if present.
+func CloseWsgiResponse(response *C.PyObject) {
 	closeString := C.CString("close")
 	defer C.free(unsafe.Pointer(closeString))
 	if C.PyObject_HasAttrString(response, closeString) == 1 {
@@ -374,18 +689,39 @@ func ReadWsgiResponseToWriter(response *C.PyObject, w io.Writer) error {
 		C.PyObject_CallObject(close, nil)
 		C.Py_DecRef(close)
 	}
-
-	return nil
 }
 
-func InitPythonInterpreter(module_name string) {
+func InitPythonInterpreter() {
 	// We need to lock the calling thread, since we want to be able to deinit
 	// later from the same thread.
 	runtime.LockOSThread()
 
 	C.register_wsgo_module() // must happen before Py_Initialize
 
-	C.initialise_python()
+	var program_name, home *C.char
+	if virtualenv != "" {
+		python := filepath.Join(virtualenv, "bin", "python")
+		if _, err := os.Stat(python); err != nil {
+			ExitProcessInvalid("Couldn't find virtualenv: " + err.Error())
+		}
+		basePrefix, err := VirtualenvBasePrefix(virtualenv)
+		if err != nil {
+			ExitProcessInvalid("Couldn't find virtualenv: " + err.Error())
+		}
+		program_name = C.CString(python)
+		defer C.free(unsafe.Pointer(program_name))
+		home = C.CString(basePrefix)
+		defer C.free(unsafe.Pointer(home))
+	}
+
+	C.initialise_python(program_name, home)
+
+	version := strings.SplitN(C.GoString(C.Py_GetVersion()), " ", 2)[0]
+	log.Println("Process", process, "loaded Python", version, "from", GetSysString("prefix"))
+	if virtualenv != "" && GetSysString("prefix") == GetSysString("base_prefix") {
+		// Rather than quietly running without the virtualenv's packages
+		ExitProcessInvalid("Didn't detect a virtualenv in " + virtualenv + " (it may be for a different Python version)")
+	}
 
 	s := C.CString("path")
 	sys_path := C.PySys_GetObject(s)
@@ -395,6 +731,15 @@ func InitPythonInterpreter(module_name string) {
 	C.PyList_Append(sys_path, C.PyUnicode_FromString(s))
 	C.free(unsafe.Pointer(s))
 
+	// --pythonpath entries take precedence, as with PYTHONPATH
+	for i, path := range pythonPaths {
+		s = C.CString(path)
+		item := C.PyUnicode_FromString(s)
+		C.PyList_Insert(sys_path, C.Py_ssize_t(i), item)
+		C.Py_DecRef(item)
+		C.free(unsafe.Pointer(s))
+	}
+
 	// Note - faulthandler can segfault when printing tracebacks in response to
 	// signals since the GIL doesn't get acquired, and stack state can change
 	// underneath it. Thus we will handle the SIGUSR1-triggered stack traces
@@ -428,30 +773,168 @@ class RequestTimeoutException(Exception):
 	pass
 wsgo.RequestTimeoutException = RequestTimeoutException
 wsgo.RequestTimeoutException.__module__ = "wsgo"
+
+def _autoreload_files():
+	import sys
+	files = set()
+	for m in list(sys.modules.values()):
+		f = getattr(m, '__file__', None)
+		if isinstance(f, str):
+			files.add(f)
+	# Include the files involved in the last error, in case they never
+	# finished importing
+	v = getattr(sys, 'last_value', None)
+	if isinstance(v, SyntaxError) and v.filename:
+		files.add(v.filename)
+	tb = getattr(sys, 'last_traceback', None)
+	while tb is not None:
+		files.add(tb.tb_frame.f_code.co_filename)
+		tb = tb.tb_next
+	return [f for f in files if not f.startswith('<')]
+wsgo._autoreload_files = _autoreload_files
+
+def _autoreload_import_files(spec):
+	# Where the application module would be found, so that it being created
+	# (or its directory changing) is noticed even if nothing could be imported.
+	import os, sys
+	parts = spec.partition(':')[0].split('.')
+	files = []
+	for d in sys.path:
+		d = os.path.abspath(d or '.')
+		if not os.path.isdir(d):
+			continue
+		base = os.path.join(d, *parts)
+		files += [d, base + '.py', os.path.join(base, '__init__.py')]
+	return files
+wsgo._autoreload_import_files = _autoreload_import_files
+
+def _add_virtualenv_site_packages(venv):
+	# Normally found by the site module already, in which case this does nothing
+	import os, site, sys
+	lib = 'python%d.%d' % sys.version_info[:2]
+	site.addsitedir(os.path.join(venv, 'lib', lib, 'site-packages'))
+wsgo._add_virtualenv_site_packages = _add_virtualenv_site_packages
+
+def _stacks():
+	import sys, threading, traceback
+	names = {t.ident: t.name for t in threading.enumerate()}
+	out = []
+	for ident, frame in sys._current_frames().items():
+		if ident == threading.get_ident():
+			continue
+		out.append('Thread %d (%s):\n' % (ident, names.get(ident, 'worker')))
+		out.extend(traceback.format_stack(frame))
+	return ''.join(out)
+wsgo._stacks = _stacks
+
+def _load_application(spec):
+	import ast, importlib
+	module_name, _, expr = spec.partition(':')
+	app = importlib.import_module(module_name)
+	node = ast.parse(expr or 'application', mode='eval').body
+	call = None
+	if isinstance(node, ast.Call):
+		call, node = node, node.func
+	names = []
+	while isinstance(node, ast.Attribute):
+		names.insert(0, node.attr)
+		node = node.value
+	if not isinstance(node, ast.Name):
+		raise ValueError('invalid application: %s' % spec)
+	for name in [node.id] + names:
+		app = getattr(app, name)
+	if call is not None:
+		# Only literal arguments, rather than evaluating arbitrary code
+		if any(k.arg is None for k in call.keywords):
+			raise ValueError('invalid application: %s' % spec)
+		args = [ast.literal_eval(a) for a in call.args]
+		kwargs = {k.arg: ast.literal_eval(k.value) for k in call.keywords}
+		app = app(*args, **kwargs)
+	return app
+wsgo._load_application = _load_application
+
+class WebSocketClosed(Exception):
+	pass
+wsgo.WebSocketClosed = WebSocketClosed
+wsgo.WebSocketClosed.__module__ = "wsgo"
+
+class WebSocket:
+	def __init__(self, request_id, protocol):
+		self._id = request_id
+		self._status = None
+		self.protocol = protocol
+
+	def receive(self, timeout=None):
+		"""
+		Returns the next message (str or bytes), or None once the WebSocket
+		has closed. Raises TimeoutError if no message arrives in time.
+		"""
+		message = wsgo._websocket_receive(self._id, -1 if timeout is None else timeout)
+		if message is None:
+			self._get_status()
+		return message
+
+	def send(self, data):
+		wsgo._websocket_send(self._id, data, False)
+
+	def ping(self, data=b''):
+		wsgo._websocket_send(self._id, data, True)
+
+	def close(self, code=1000, reason=''):
+		wsgo._websocket_close(self._id, code, reason)
+		self._get_status()
+
+	def _get_status(self):
+		if self._status is None:
+			self._status = wsgo._websocket_status(self._id)
+		return self._status
+
+	@property
+	def closed(self):
+		return self._get_status() is not None
+
+	@property
+	def close_code(self):
+		status = self._get_status()
+		return status and status[0]
+
+	@property
+	def close_reason(self):
+		status = self._get_status()
+		return status and status[1]
+
+	def __iter__(self):
+		while True:
+			message = self.receive()
+			if message is None:
+				return
+			yield message
+wsgo.WebSocket = WebSocket
+wsgo.WebSocket.__module__ = "wsgo"
+
+def websocket(environ, protocol=None, idle_timeout=None):
+	request_id = environ.get('wsgo.websocket')
+	if request_id is None:
+		raise ValueError('not a WebSocket request')
+	wsgo._websocket_accept(request_id, protocol, idle_timeout)
+	return WebSocket(request_id, protocol)
+wsgo.websocket = websocket
 `)
 	defer C.free(unsafe.Pointer(cmd))
 	C.PyRun_SimpleStringFlags(cmd, nil)
 
-	s = C.CString(module_name)
-	defer C.free(unsafe.Pointer(s))
-	app := C.PyImport_ImportModule(s)
-	if app == nil {
-		C.PyErr_Print()
-		ExitProcessInvalid("Couldn't import module: " + module_name)
-	}
-
-	app_dict := C.PyModule_GetDict(app)
-	if app_dict == nil {
-		ExitProcessInvalid("Couldn't import module dict?")
+	if virtualenv != "" {
+		if ret := CallWsgoFunction("_add_virtualenv_site_packages", virtualenv); ret == nil {
+			C.PyErr_Print()
+			ExitProcessInvalid("Couldn't add the virtualenv's site-packages")
+		} else {
+			C.Py_DecRef(ret)
+		}
 	}
 
-	s = C.CString("application")
-	app_func = C.PyDict_GetItemString(app_dict, s)
-	C.free(unsafe.Pointer(s))
-	C.Py_IncRef(app_func)
-	C.Py_DecRef(app_dict)
-	if app_func == nil {
-		ExitProcessInvalid("Couldn't find 'application' entrypoint in module")
+	mounts, _ = ParseMounts()
+	for _, m := range mounts {
+		m.app = LoadApplication(m.spec)
 	}
 
 	start_response_def.ml_name = C.CString("start_response")
@@ -463,6 +946,54 @@ wsgo.RequestTimeoutException.__module__ = "wsgo"
 	C.PyEval_SaveThread()
 }
 
+// Returns the prefix of the Python installation a virtualenv was created from,
+// which is the directory above the 'home' given in its pyvenv.cfg.
+func VirtualenvBasePrefix(venv string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(venv, "pyvenv.cfg"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, found := strings.Cut(line, "=")
+		if found && strings.TrimSpace(key) == "home" {
+			return filepath.Dir(strings.TrimSpace(value)), nil
+		}
+	}
+	return "", errors.New("no home in " + filepath.Join(venv, "pyvenv.cfg"))
+}
+
+// Returns a string attribute of the sys module. Must be called with the GIL
+// held.
+func GetSysString(name string) string {
+	s := C.CString(name)
+	defer C.free(unsafe.Pointer(s))
+	value := C.PySys_GetObject(s) // borrowed reference
+	if value == nil {
+		return ""
+	}
+	u := C.PyUnicode_AsUTF8(value)
+	if u == nil {
+		C.PyErr_Clear()
+		return ""
+	}
+	return C.GoString(u)
+}
+
+// Loads the application given as module, module:callable or
+// module:factory(args), returning a new reference to it. Must be called with
+// the GIL held.
+func LoadApplication(spec string) *C.PyObject {
+	app := CallWsgoFunction("_load_application", spec)
+	if app == nil {
+		C.PyErr_Print()
+		if pyAutoreload {
+			WaitForChangesAfterImportError(spec)
+		}
+		ExitProcessInvalid("Couldn't load application: " + spec)
+	}
+	return app
+}
+
 func DeinitPythonInterpreter() {
 	// Grab the gil
 	C.PyGILState_Ensure()
@@ -493,6 +1024,88 @@ func PyEval(code string) (*C.PyObject, func()) {
 	return obj, done
 }
 
+// Calls one of the helper functions on the wsgo module, returning a new
+// reference to the result (or nil on error). Must be called with the GIL held.
+func CallWsgoFunction(name string, args ...string) *C.PyObject {
+	objects := make([]*C.PyObject, len(args))
+	for i, arg := range args {
+		s := C.CString(arg)
+		objects[i] = C.PyUnicode_FromString(s)
+		C.free(unsafe.Pointer(s))
+	}
+
+	ret := CallWsgoFunctionObjects(name, objects...)
+	for _, obj := range objects {
+		C.Py_DecRef(obj)
+	}
+	return ret
+}
+
+// As CallWsgoFunction, but with Python objects as the arguments (which are
+// borrowed, not stolen).
+func CallWsgoFunctionObjects(name string, args ...*C.PyObject) *C.PyObject {
+	function := GetWsgoAttribute(name)
+	if function == nil {
+		return nil
+	}
+	var function_args *C.PyObject
+	if len(args) > 0 {
+		function_args = C.PyTuple_New(C.Py_ssize_t(len(args)))
+		for i, arg := range args {
+			C.Py_IncRef(arg)
+			C.PyTuple_SetItem(function_args, C.Py_ssize_t(i), arg) //steals
+		}
+	}
+
+	ret := C.PyObject_CallObject(function, function_args)
+	C.Py_DecRef(function)
+	if function_args != nil {
+		C.Py_DecRef(function_args)
+	}
+	return ret
+}
+
+// Returns a new reference to an attribute of the wsgo module.
+func GetWsgoAttribute(name string) *C.PyObject {
+	mod_name := C.CString("wsgo")
+	defer C.free(unsafe.Pointer(mod_name))
+	mod := C.PyImport_AddModule(mod_name) // borrowed reference
+
+	attr_name := C.CString(name)
+	defer C.free(unsafe.Pointer(attr_name))
+	return C.PyObject_GetAttrString(mod, attr_name)
+}
+
+// Runs f with the GIL released. Must be called with the GIL held.
+func WithoutGIL(f func()) {
+	runtime.LockOSThread()
+	threadState := C.PyEval_SaveThread()
+	f()
+	C.PyEval_RestoreThread(threadState)
+	runtime.UnlockOSThread()
+}
+
+// Returns the current stack of every Python thread.
+func GetPythonStacks() string {
+	runtime.LockOSThread()
+	gilState := C.PyGILState_Ensure()
+
+	stacks := ""
+	ret := CallWsgoFunction("_stacks")
+	if ret == nil {
+		C.PyErr_Print()
+	} else {
+		if s := C.PyUnicode_AsUTF8(ret); s != nil {
+			stacks = C.GoString(s)
+		}
+		C.Py_DecRef(ret)
+	}
+
+	C.PyGILState_Release(gilState)
+	runtime.UnlockOSThread()
+	return stacks
+}
+
 func GetThreadCpuTime() uint64 {
 	return uint64(C.get_thread_cpu_time());
 }
\ No newline at end of file
@@ -7,8 +7,6 @@ import (
 	"sync/atomic"
 	"time"
 	"unsafe"
-
-	"golang.org/x/sys/unix"
 )
 
 /*
@@ -27,6 +25,13 @@ type PythonWorker struct {
 	gilState    C.PyGILState_STATE
 	// This is used to remember the threadstate between successive tasks
 	threadState *C.PyThreadState
+	// The request currently being handled (if any), and when it started
+	activeJob   atomic.Pointer[RequestJob]
+	activeSince atomic.Int64
+	// The WebSocket the current request has been taken over as (if any)
+	webSocket   atomic.Pointer[WebSocket]
+	// Sent to once the current request starts streaming its response
+	streamingStarted chan bool
 }
 
 var workers []*PythonWorker
@@ -64,6 +69,8 @@ func GetRequestTimeoutException() (*C.PyObject) {
 }
 
 func StartWorkers() {
+	InitCpuAffinity()
+
 	workers = make([]*PythonWorker, totalWorkers)
 
 	log.Println("Process", strconv.Itoa(process), "starting", strconv.Itoa(totalWorkers), "workers.")
@@ -96,6 +103,9 @@ func (worker *PythonWorker) RunPythonTask(task func(), timeout int) (time.Time,
 
 	pydone := make(chan bool, 1)
 	thread_id := C.PyThread_get_thread_ident()
+	streamingStarted := make(chan bool, 1)
+	worker.streamingStarted = streamingStarted
+	start := time.Now()
 
 	if timeout > 0 {
 		// Add a request timeout to interrupt the worker
@@ -116,16 +126,51 @@ func (worker *PythonWorker) RunPythonTask(task func(), timeout int) (time.Time,
 			// 		default:
 			// 	}
 
+			case <-streamingStarted:
+				// Streamed responses have their own time limit instead,
+				// counted from the start of the request.
+				if streamingTimeout <= 0 {
+					<-pydone
+					return
+				}
+				remaining := time.Until(start.Add(time.Duration(streamingTimeout) * time.Second))
+				if remaining < 0 {
+					remaining = 0
+				}
+				select {
+				case <-pydone:
+					return
+				case <-time.After(remaining):
+				}
+				log.Println("Streaming response timed out!")
+
 			case <-time.After(time.Duration(timeout) * time.Second):
-				log.Println("Task timed out!")
+				if ws := worker.webSocket.Load(); ws != nil {
+					// WebSockets have their own idle timeout instead, but
+					// once the connection has closed the application should
+					// finish promptly.
+					select {
+					case <-pydone:
+						return
+					case <-ws.done:
+					}
+					select {
+					case <-pydone:
+						return
+					case <-time.After(WEBSOCKET_FINISH_TIMEOUT):
+					}
+					log.Println("WebSocket task didn't finish after its connection closed!")
+				} else {
+					log.Println("Task timed out!")
+				}
+			}
 
-				// Flag the worker as stuck, so we can detect whether our
-				// attempt at interrupting it hasn't worked
-				worker.stuck.Store(true)
+			// Flag the worker as stuck, so we can detect whether our
+			// attempt at interrupting it hasn't worked
+			worker.stuck.Store(true)
 
-				// Print a fancy traceback so we can see where it is stuck
-				PrintPythonTraceback()
-			}
+			// Print a fancy traceback so we can see where it is stuck
+			PrintPythonTraceback()
 
 			runtime.LockOSThread()
 			gs := C.PyGILState_Ensure()
@@ -142,8 +187,6 @@ func (worker *PythonWorker) RunPythonTask(task func(), timeout int) (time.Time,
 		}()
 	}
 
-	start := time.Now()
-
 	task()
 
 	if worker.stuck.Load() {
@@ -166,27 +209,42 @@ func (worker *PythonWorker) RunPythonTask(task func(), timeout int) (time.Time,
 	return finish, elapsed, cpu_elapsed
 }
 
+// Marks the current request as streaming its response, so that the streaming
+// timeout applies instead of the request timeout.
+func (worker *PythonWorker) StartStreaming() {
+	select {
+	case worker.streamingStarted <- true:
+	default:
+	}
+}
+
 func (worker *PythonWorker) Run() {
 	// It is important that this goroutine always uses the same OS thread, else
 	// the Python GIL will get very upset.
 	runtime.LockOSThread()
 
-	// Pin all the threads to the same CPU, which should reduce the 'convoy problem' caused by the GIL
-	var cpuSet unix.CPUSet
-	unix.SchedGetaffinity(0, &cpuSet)
-	cpuCount := cpuSet.Count()
-	cpuSet.Zero()
-	cpuSet.Set(process % cpuCount)
-	unix.SchedSetaffinity(0, &cpuSet)
+	PinWorkerThread()
 
 	for {
 		job := scheduler.GrabJob()
 
 		job.worker = worker.number
+		worker.activeSince.Store(time.Now().UnixNano())
+		worker.activeJob.Store(job)
+
+		// ASGI requests are cancelled on the event loop when they time out,
+		// rather than interrupting the worker.
+		timeout := requestTimeout
+		if asgiMode {
+			timeout = 0
+		}
 
 		job.finish, job.elapsed, job.cpuElapsed = worker.RunPythonTask(func() {
 			worker.HandleJob(job)
-		}, requestTimeout)
+		}, timeout)
+
+		worker.activeJob.Store(nil)
+		worker.webSocket.Store(nil)
 
 		scheduler.JobFinished(job)
 	}
@@ -195,13 +253,7 @@ func (worker *PythonWorker) Run() {
 func (worker *PythonWorker) BackgroundWorkerRun() {
 	runtime.LockOSThread()
 
-	// Pin all the threads to the same CPU, which should reduce the 'convoy problem' caused by the GIL
-	var cpuSet unix.CPUSet
-	unix.SchedGetaffinity(0, &cpuSet)
-	cpuCount := cpuSet.Count()
-	cpuSet.Zero()
-	cpuSet.Set(process % cpuCount)
-	unix.SchedSetaffinity(0, &cpuSet)
+	PinWorkerThread()
 
 	for {
 		backgroundJob := <-backgroundJobs
@@ -234,17 +286,38 @@ func (worker *PythonWorker) HandleJob(job *RequestJob) {
 	AddWsgiRequestReader(requestId, job.r)
 	defer RemoveWsgiRequestReader(requestId)
 
+	if asgiMode {
+		HandleAsgiJob(requestId, job)
+		return
+	}
+
+	if IsWebSocketRequest(job.req) {
+		AddWebSocketRequest(requestId, job)
+		defer RemoveWebSocketRequest(requestId)
+	}
+
 	ret := CallApplication(requestId, job.req)
 
-	BadGateway := func() {
-		job.w.WriteHeader(502)
-		job.w.Write([]byte("Bad Gateway"))
-		errorCount.Add(1)
+	if ws := TakeWebSocket(requestId); ws != nil {
+		// The application took over the connection as a WebSocket, so there's
+		// no response to send.
+		code := WEBSOCKET_CLOSE_NORMAL
+		if ret == nil {
+			C.PyErr_Print()
+			code = WEBSOCKET_CLOSE_INTERNAL_ERROR
+		} else {
+			CloseWsgiResponse(ret)
+			C.Py_DecRef(ret)
+		}
+		WithoutGIL(func() {
+			ws.Close(code, "")
+		})
+		return
 	}
 
 	if ret == nil {
 		C.PyErr_Print()
-		BadGateway()
+		SendBadGateway(job)
 		return
 	}
 
@@ -254,13 +327,16 @@ func (worker *PythonWorker) HandleJob(job *RequestJob) {
 
 	if responseStart.status == 0 {
 		log.Println("start_response wasn't called")
-		BadGateway()
+		SendBadGateway(job)
 		return
 	}
 
 	job.statusCode = responseStart.status
 
 	for k, vv := range responseStart.headers {
+		if IsConnectionSpecificHeader(job.req, k) {
+			continue
+		}
 		for _, v := range vv {
 			job.w.Header().Add(k, v)
 		}
@@ -276,11 +352,26 @@ func (worker *PythonWorker) HandleJob(job *RequestJob) {
 
 	job.w.WriteHeader(responseStart.status)
 
-	if ReadWsgiResponseToWriter(ret, job.w) != nil {
-		BadGateway()
+	streaming := IsStreamingResponse(job.w.Header()) && IsIncrementalResponse(ret)
+	if streaming {
+		// Each client should get the stream as it happens, not a replay.
+		job.w.skipCaching = true
+		if job.worker > 0 {
+			workers[job.worker-1].StartStreaming()
+		}
+	}
+
+	if ReadWsgiResponseToWriter(ret, job.w, streaming) != nil {
+		SendBadGateway(job)
 	}
 }
 
+func SendBadGateway(job *RequestJob) {
+	job.w.WriteHeader(502)
+	job.w.Write([]byte("Bad Gateway"))
+	errorCount.Add(1)
+}
+
 func (worker *PythonWorker) HandleBackgroundJob(job *BackgroundJob) {
 	app_func_args := C.PyTuple_New(0)
 	defer C.Py_DecRef(app_func_args)
@@ -0,0 +1,92 @@
+package wsgo
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait for the process manager to replace us before asking again.
+var RECYCLE_RETRY_INTERVAL = 60 * time.Second
+
+// Adds a random amount (up to recycleJitter percent) to a limit, so that
+// processes started together don't all recycle at the same time.
+func jittered(limit int) int {
+	if limit <= 0 || recycleJitter <= 0 {
+		return limit
+	}
+	return limit + rand.Intn(limit*recycleJitter/100+1)
+}
+
+// Returns the resident set size of this process in bytes.
+func GetRss() uint64 {
+	b, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * uint64(os.Getpagesize())
+}
+
+// Returns why this process should be recycled, or "" if it shouldn't yet.
+func checkRecycleLimits(start time.Time, requestLimit int, lifetimeLimit int) string {
+	if requestLimit > 0 && requestCount.Load() >= uint64(requestLimit) {
+		return "handled " + strconv.Itoa(requestLimit) + " requests"
+	}
+	if lifetimeLimit > 0 && time.Since(start) >= time.Duration(lifetimeLimit)*time.Second {
+		return "reached lifetime of " + strconv.Itoa(lifetimeLimit) + "s"
+	}
+	if reloadOnRss > 0 {
+		rss := GetRss()
+		if rss > uint64(reloadOnRss)*1024*1024 {
+			return "RSS of " + strconv.FormatUint(rss/1024/1024, 10) + "MB exceeds limit"
+		}
+	}
+	return ""
+}
+
+// Periodically checks whether this process has hit any of its recycling
+// limits, and if so gets it replaced.
+func RecycleRoutine() {
+	if maxRequests <= 0 && maxLifetime <= 0 && reloadOnRss <= 0 {
+		return
+	}
+
+	start := time.Now()
+	requestLimit := jittered(maxRequests)
+	lifetimeLimit := jittered(maxLifetime)
+
+	for {
+		time.Sleep(1 * time.Second)
+
+		reason := checkRecycleLimits(start, requestLimit, lifetimeLimit)
+		if reason == "" {
+			continue
+		}
+
+		log.Println("Process", process, "recycling:", reason)
+
+		if managerConn == nil {
+			// No process manager to start a replacement first, so just
+			// restart.
+			RestartProcess(reason)
+			return
+		}
+
+		// Ask the process manager to start a replacement, which will then
+		// gracefully stop us. If it can't (maybe the new process failed to
+		// start), we'll keep running and ask again later.
+		NotifyManager(ProcessMessage{Type: "recycle", Reason: reason})
+		time.Sleep(RECYCLE_RETRY_INTERVAL)
+	}
+}
@@ -0,0 +1,80 @@
+package wsgo
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The delay before restarting a crashed process, which doubles with each
+// consecutive crash up to --restart-delay-max.
+var RESTART_DELAY_MIN = 100 * time.Millisecond
+
+// When each process has recently crashed, across all slots.
+var crashTimes []time.Time
+var crashTimesMutex sync.Mutex
+
+var processManagerExitCode int = 0
+
+// Describes how a child process exited, for logging.
+func DescribeExit(state *os.ProcessState) string {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return state.String()
+	}
+	if status.Signaled() {
+		desc := fmt.Sprintf("killed by signal %d (%s)", int(status.Signal()), status.Signal())
+		if status.CoreDump() {
+			desc += ", core dumped"
+		}
+		return desc
+	}
+	return fmt.Sprintf("exit status %d", status.ExitStatus())
+}
+
+// Records a crash, returning how many there have been within the crash window.
+func RecordCrash() int {
+	crashTimesMutex.Lock()
+	defer crashTimesMutex.Unlock()
+
+	now := time.Now()
+	window := time.Duration(crashWindow) * time.Second
+	recent := []time.Time{}
+	for _, t := range crashTimes {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	crashTimes = append(recent, now)
+	return len(crashTimes)
+}
+
+func NextRestartDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if max := time.Duration(restartDelayMax) * time.Second; delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Sleeps for the given duration, returning false if the process manager
+// started stopping in the meantime.
+func SleepUnlessStopping(d time.Duration) bool {
+	select {
+	case <-processManagerStopped:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Gives up on a crash-looping application, stopping every process so that the
+// process manager exits with an error.
+func CrashLoopDetected(crashes int) {
+	log.Println("Processes crashed", crashes, "times in the last", crashWindow, "seconds, giving up!")
+	processManagerExitCode = 1
+	StopChildProcesses()
+}
@@ -0,0 +1,181 @@
+package wsgo
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long the load has to stay high (or low) before adding (or removing) a
+// process.
+var SCALE_UP_AFTER = 5 * time.Second
+var SCALE_DOWN_AFTER = 30 * time.Second
+
+func InitScaling() {
+	if minProcesses <= 0 {
+		minProcesses = processes
+	}
+	if maxProcesses <= 0 {
+		maxProcesses = processes
+	}
+	if maxProcesses < minProcesses {
+		maxProcesses = minProcesses
+	}
+	if processes < minProcesses {
+		processes = minProcesses
+	}
+	if processes > maxProcesses {
+		processes = maxProcesses
+	}
+}
+
+// Guards minProcesses and maxProcesses once the process manager is running,
+// since SIGTTIN and SIGTTOU change them.
+var scalingBoundsMutex sync.Mutex
+
+// Returns the current --min-processes and --max-processes.
+func ScalingBounds() (int, int) {
+	scalingBoundsMutex.Lock()
+	defer scalingBoundsMutex.Unlock()
+	return minProcesses, maxProcesses
+}
+
+// The most processes there may be, as known to a child process, which the
+// process manager keeps up to date (for wsgi.multiprocess).
+var childMaxProcesses atomic.Int64
+
+// Returns whether there may be more than one process.
+func IsMultiprocess() bool {
+	if childMaxProcesses.Load() > 0 {
+		return childMaxProcesses.Load() > 1
+	}
+	_, max := ScalingBounds()
+	return processes > 1 || max > 1
+}
+
+// Returns the arguments passing the current scaling bounds on to a child.
+func ScalingArgs() []string {
+	min, max := ScalingBounds()
+	return []string{
+		"--min-processes=" + strconv.Itoa(min),
+		"--max-processes=" + strconv.Itoa(max),
+	}
+}
+
+// Tells the running processes about a change in the scaling bounds.
+func NotifyScalingBounds() {
+	_, max := ScalingBounds()
+	childProcessesMutex.Lock()
+	defer childProcessesMutex.Unlock()
+	for child := range runningChildProcesses {
+		SendProcessMessage(child.conn, ProcessMessage{Type: "scaling", MaxProcesses: max})
+	}
+}
+
+func ScaleUp(reason string) {
+	if _, max := ScalingBounds(); ActiveProcessCount() >= max {
+		return
+	}
+	if n := AddProcess(); n != 0 {
+		log.Println("Starting process", n, "("+reason+").")
+	}
+}
+
+func ScaleDown(reason string) {
+	if min, _ := ScalingBounds(); ActiveProcessCount() <= min {
+		return
+	}
+	if n := RemoveProcess(); n != 0 {
+		log.Println("Stopping process", n, "("+reason+").")
+	}
+}
+
+// Adds a process on SIGTTIN, raising --max-processes if need be.
+func ManuallyAddProcess() {
+	rollingRestartMutex.Lock()
+	defer rollingRestartMutex.Unlock()
+
+	scalingBoundsMutex.Lock()
+	raised := false
+	if count := ActiveProcessCount(); count >= maxProcesses {
+		maxProcesses = count + 1
+		raised = true
+	}
+	scalingBoundsMutex.Unlock()
+
+	if raised {
+		NotifyScalingBounds()
+	}
+	ScaleUp("SIGTTIN")
+}
+
+// Removes a process on SIGTTOU, lowering --min-processes if need be.
+func ManuallyRemoveProcess() {
+	rollingRestartMutex.Lock()
+	defer rollingRestartMutex.Unlock()
+
+	scalingBoundsMutex.Lock()
+	if count := ActiveProcessCount(); count <= minProcesses && count > 1 {
+		minProcesses = count - 1
+	}
+	scalingBoundsMutex.Unlock()
+
+	ScaleDown("SIGTTOU")
+}
+
+// Adds processes while requests are queueing or most workers are busy, and
+// removes them while the rest could comfortably handle the load.
+func ScalingRoutine() {
+	var highSince, lowSince time.Time
+
+	for {
+		select {
+		case <-processManagerStopped:
+			return
+		case <-time.After(HEARTBEAT_INTERVAL):
+		}
+
+		load := GetProcessLoad()
+		if load.reporting == 0 || load.reporting < load.processes {
+			// Wait until every process (including any new ones) has reported in.
+			highSince, lowSince = time.Time{}, time.Time{}
+			continue
+		}
+		workersPerProcess := load.workers / load.reporting
+
+		high := load.queued > 0 || load.busy*4 >= load.workers*3
+		// (ie, would be under half busy with one fewer process)
+		low := load.queued == 0 && load.busy*2 < load.workers-workersPerProcess
+
+		if !high {
+			highSince = time.Time{}
+		} else if highSince.IsZero() {
+			highSince = time.Now()
+		}
+		if !low {
+			lowSince = time.Time{}
+		} else if lowSince.IsZero() {
+			lowSince = time.Now()
+		}
+
+		scaleUp := !highSince.IsZero() && time.Since(highSince) >= SCALE_UP_AFTER
+		scaleDown := !lowSince.IsZero() && time.Since(lowSince) >= SCALE_DOWN_AFTER
+		if !scaleUp && !scaleDown {
+			continue
+		}
+
+		// Don't scale during a rolling restart.
+		if !rollingRestartMutex.TryLock() {
+			continue
+		}
+		if scaleUp {
+			ScaleUp("high load")
+		} else {
+			ScaleDown("low load")
+		}
+		rollingRestartMutex.Unlock()
+		highSince, lowSince = time.Time{}, time.Time{}
+	}
+}
@@ -0,0 +1,38 @@
+package wsgo
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Closed when the process starts shutting down, to end any streamed responses.
+var streamsStopping = make(chan bool)
+var streamsStoppingOnce sync.Once
+
+// Returns whether a response should be sent on to the client as each chunk is
+// produced, rather than sitting in Go's buffers: Server-Sent Events, and those
+// which ask for it as they would of nginx.
+func IsStreamingResponse(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream" ||
+		strings.EqualFold(header.Get("X-Accel-Buffering"), "no")
+}
+
+// Ends streamed responses once their next chunk has been sent, since they
+// would otherwise hold up shutdown for as long as they keep going.
+func StopStreamingResponses() {
+	streamsStoppingOnce.Do(func() {
+		close(streamsStopping)
+	})
+}
+
+func StreamingResponsesStopped() bool {
+	select {
+	case <-streamsStopping:
+		return true
+	default:
+		return false
+	}
+}
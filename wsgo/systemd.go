@@ -0,0 +1,178 @@
+package wsgo
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The first fd passed by systemd socket activation.
+var SD_LISTEN_FDS_START = 3
+
+// Where to send sd_notify messages, and how often to ping the watchdog (taken
+// from the environment by the process manager).
+var notifySocket string
+var watchdogInterval time.Duration
+
+// Returns the number of sockets passed to us by systemd socket activation.
+func SystemdListenFds() int {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	return n
+}
+
+// Picks up any sockets passed by systemd, to be shared with the children in the
+// same way as unix sockets. Sockets named "https" (via FileDescriptorName=) are
+// served with TLS, and the rest as plain HTTP.
+func OpenSystemdListeners() {
+	n := SystemdListenFds()
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// These only apply to us, not our children.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < n; i++ {
+		fd := SD_LISTEN_FDS_START + i
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		syscall.CloseOnExec(fd)
+
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		if err != nil {
+			ExitProcessInvalid("Couldn't use socket-activated fd " + strconv.Itoa(fd) + ": " + err.Error())
+		}
+
+		address := "systemd:" + strconv.Itoa(fd) + ":" + name
+		option := "http-socket"
+		if strings.HasPrefix(name, "https") {
+			option = "https-socket"
+		}
+		log.Println("Using socket-activated", listener.Addr(), "("+name+") for", option)
+
+		// Set the option so that the children will serve it too.
+		flag.Set(option, address)
+		optionSources[option] = "systemd"
+
+		managerListeners = append(managerListeners, listener)
+		managerListenerFiles = append(managerListenerFiles, f)
+		managerListenerAddresses = append(managerListenerAddresses, address)
+	}
+}
+
+func InitSystemdNotify() {
+	notifySocket = os.Getenv("NOTIFY_SOCKET")
+	watchdogPid := os.Getenv("WATCHDOG_PID")
+	if usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC")); err == nil && usec > 0 {
+		if watchdogPid == "" || watchdogPid == strconv.Itoa(os.Getpid()) {
+			watchdogInterval = time.Duration(usec) * time.Microsecond
+		}
+	}
+
+	// Stop the children from trying to notify systemd themselves.
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+}
+
+// Sends a state update to systemd, if we were started with a notify socket.
+func SdNotify(state string) {
+	if notifySocket == "" {
+		return
+	}
+	// (Go treats a leading @ as an abstract socket address)
+	conn, err := net.Dial("unixgram", notifySocket)
+	if err != nil {
+		log.Println("Couldn't connect to systemd notify socket:", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Println("Couldn't notify systemd:", err)
+	}
+}
+
+// Waits for every initial process to have imported the application and become
+// ready to serve requests, returning false if the process manager is stopping.
+func WaitForProcessesReady() bool {
+	for n := 1; n <= processes; n++ {
+		for {
+			childProcessesMutex.Lock()
+			child := childProcesses[n]
+			childProcessesMutex.Unlock()
+
+			// (if the slot's process exits or is replaced, we'll time out and
+			// look at the new one)
+			var ready chan bool
+			if child != nil {
+				ready = child.ready
+			}
+			select {
+			case <-processManagerStopped:
+				return false
+			case <-time.After(100 * time.Millisecond):
+				continue
+			case <-ready:
+			}
+			break
+		}
+	}
+	return true
+}
+
+// Returns a status line for the current processes, and whether any workers are
+// able to handle requests.
+func ProcessStatus() (string, bool) {
+	load := GetProcessLoad()
+	status := fmt.Sprintf("%d processes, %d/%d workers busy (%d stuck), %d queued requests",
+		load.processes, load.busy, load.workers, load.stuck, load.queued)
+	return status, load.workers == 0 || load.stuck < load.workers
+}
+
+// Tells systemd when we're ready, keeps our status up to date, and pings the
+// watchdog as long as there are workers that aren't stuck.
+func SystemdNotifyRoutine() {
+	if notifySocket == "" {
+		return
+	}
+
+	if watchdogInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(watchdogInterval / 2)
+				if _, healthy := ProcessStatus(); healthy {
+					SdNotify("WATCHDOG=1")
+				} else {
+					log.Println("All workers are stuck, not pinging systemd watchdog.")
+				}
+			}
+		}()
+	}
+
+	if !WaitForProcessesReady() {
+		return
+	}
+	SdNotify("READY=1")
+
+	lastStatus := ""
+	for {
+		status, _ := ProcessStatus()
+		if status != lastStatus {
+			SdNotify("STATUS=" + status)
+			lastStatus = status
+		}
+		time.Sleep(HEARTBEAT_INTERVAL)
+	}
+}
@@ -0,0 +1,74 @@
+package wsgo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+// The currently loaded certificates, replaced wholesale on reload so that
+// handshakes in progress aren't affected.
+var tlsCertificates atomic.Pointer[[]tls.Certificate]
+
+func LoadCertificates() error {
+	if len(tlsCertFiles) == 0 {
+		return errors.New("--https-socket requires --tls-cert and --tls-key")
+	}
+	if len(tlsCertFiles) != len(tlsKeyFiles) {
+		return errors.New("--tls-cert and --tls-key must be given the same number of times")
+	}
+
+	var certs []tls.Certificate
+	for i := range tlsCertFiles {
+		cert, err := tls.LoadX509KeyPair(tlsCertFiles[i], tlsKeyFiles[i])
+		if err != nil {
+			return err
+		}
+		// Parse the leaf up front, rather than on every handshake.
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	tlsCertificates.Store(&certs)
+	return nil
+}
+
+// Chooses a certificate based on the SNI server name, falling back to the
+// first one.
+func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := *tlsCertificates.Load()
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return &certs[0], nil
+}
+
+func NewTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: GetCertificate,
+		NextProtos:     ALPNProtocols(),
+	}
+}
+
+// Reloads the certificates from disk, for the 'certs' control command. Existing
+// connections keep using the certificate they were established with, and the
+// old certificates are kept if the new ones can't be loaded.
+func ReloadCertificates() error {
+	if len(httpsAddresses) == 0 {
+		return errors.New("there are no HTTPS sockets")
+	}
+	if err := LoadCertificates(); err != nil {
+		log.Println("Process", process, "failed to reload TLS certificates:", err)
+		return err
+	}
+	log.Println("Process", process, "reloaded TLS certificates.")
+	return nil
+}
@@ -0,0 +1,653 @@
+package wsgo
+
+/*
+#include <Python.h>
+*/
+import "C"
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+	"unsafe"
+)
+
+const WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes
+const (
+	WEBSOCKET_CONTINUATION = 0x0
+	WEBSOCKET_TEXT         = 0x1
+	WEBSOCKET_BINARY       = 0x2
+	WEBSOCKET_CLOSE        = 0x8
+	WEBSOCKET_PING         = 0x9
+	WEBSOCKET_PONG         = 0xa
+)
+
+// Close codes
+const (
+	WEBSOCKET_CLOSE_NORMAL         = 1000
+	WEBSOCKET_CLOSE_GOING_AWAY     = 1001
+	WEBSOCKET_CLOSE_PROTOCOL_ERROR = 1002
+	WEBSOCKET_CLOSE_NO_STATUS      = 1005
+	WEBSOCKET_CLOSE_ABNORMAL       = 1006
+	WEBSOCKET_CLOSE_INVALID_DATA   = 1007
+	WEBSOCKET_CLOSE_TOO_BIG        = 1009
+	WEBSOCKET_CLOSE_INTERNAL_ERROR = 1011
+)
+
+// How long to wait for the client to answer our close frame.
+var WEBSOCKET_CLOSE_TIMEOUT = 5 * time.Second
+
+// How long an application may carry on for once its WebSocket has closed,
+// before it is interrupted (or, when shutting down, abandoned).
+var WEBSOCKET_FINISH_TIMEOUT = 5 * time.Second
+
+// How long a write to the client may take.
+var WEBSOCKET_WRITE_TIMEOUT = 10 * time.Second
+
+var errWebSocketClosed = errors.New("WebSocket is closed")
+var errWebSocketTimeout = errors.New("timed out")
+
+// A protocol violation by the client, closing the connection with the given
+// code.
+type webSocketError struct {
+	code   int
+	reason string
+}
+
+func (e *webSocketError) Error() string {
+	return e.reason
+}
+
+type WebSocketMessage struct {
+	text bool
+	data []byte
+}
+
+type WebSocket struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	idleTimeout time.Duration
+
+	messages chan WebSocketMessage
+	// closed once the connection has been closed
+	done     chan bool
+	doneOnce sync.Once
+
+	writeMutex sync.Mutex
+	closeSent  bool
+
+	statusMutex sync.Mutex
+	closeCode   int
+	closeReason string
+}
+
+// Requests which the application could accept as a WebSocket, and the
+// WebSockets it has accepted, by request id.
+var webSocketRequests = make(map[int64]*RequestJob)
+var webSockets = make(map[int64]*WebSocket)
+var webSocketsMutex sync.Mutex
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, v := range header.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns whether the request is asking to be upgraded to a WebSocket. Only
+// HTTP/1.1 connections can be taken over.
+func IsWebSocketRequest(req *http.Request) bool {
+	return req.Method == "GET" && req.ProtoMajor == 1 &&
+		headerContainsToken(req.Header, "Connection", "upgrade") &&
+		headerContainsToken(req.Header, "Upgrade", "websocket")
+}
+
+func AddWebSocketRequest(requestId int64, job *RequestJob) {
+	webSocketsMutex.Lock()
+	webSocketRequests[requestId] = job
+	webSocketsMutex.Unlock()
+}
+
+func RemoveWebSocketRequest(requestId int64) {
+	webSocketsMutex.Lock()
+	delete(webSocketRequests, requestId)
+	webSocketsMutex.Unlock()
+}
+
+func GetWebSocket(requestId int64) *WebSocket {
+	webSocketsMutex.Lock()
+	defer webSocketsMutex.Unlock()
+	return webSockets[requestId]
+}
+
+// Removes and returns the WebSocket for a request, if it was accepted.
+func TakeWebSocket(requestId int64) *WebSocket {
+	webSocketsMutex.Lock()
+	defer webSocketsMutex.Unlock()
+	ws := webSockets[requestId]
+	delete(webSockets, requestId)
+	return ws
+}
+
+// Completes the handshake for a WebSocket request, taking over its connection.
+// The protocol (if given) must be one the client offered.
+func AcceptWebSocket(requestId int64, protocol string, idleTimeout time.Duration) (*WebSocket, error) {
+	webSocketsMutex.Lock()
+	job := webSocketRequests[requestId]
+	delete(webSocketRequests, requestId)
+	webSocketsMutex.Unlock()
+
+	if job == nil {
+		return nil, errors.New("not a WebSocket request, or already accepted")
+	}
+
+	if job.req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	key := job.req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, errors.New("invalid Sec-WebSocket-Key")
+	}
+	if protocol != "" && !headerContainsToken(job.req.Header, "Sec-WebSocket-Protocol", protocol) {
+		return nil, errors.New("protocol " + protocol + " wasn't offered by the client")
+	}
+
+	conn, rw, err := http.NewResponseController(job.w.writer).Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection is ours now, so nothing more gets written via the
+	// response writer.
+	job.w.finished = true
+	job.w.skipCaching = true
+	job.statusCode = 101
+
+	accept := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n"
+	if protocol != "" {
+		response += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	response += "\r\n"
+
+	// Clear the server's deadlines, which were for the HTTP request.
+	conn.SetDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &WebSocket{
+		conn:        conn,
+		reader:      rw.Reader,
+		idleTimeout: idleTimeout,
+		messages:    make(chan WebSocketMessage, 16),
+		done:        make(chan bool),
+	}
+
+	if job.worker > 0 {
+		// The idle timeout applies instead of the request timeout.
+		workers[job.worker-1].webSocket.Store(ws)
+	}
+
+	webSocketsMutex.Lock()
+	webSockets[requestId] = ws
+	webSocketsMutex.Unlock()
+
+	go ws.ReadLoop()
+
+	return ws, nil
+}
+
+func (ws *WebSocket) ReadFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &webSocketError{WEBSOCKET_CLOSE_PROTOCOL_ERROR, "reserved bits set"}
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &webSocketError{WEBSOCKET_CLOSE_PROTOCOL_ERROR, "frame not masked"}
+	}
+
+	length := uint64(header[1] & 0x7f)
+	if length == 126 {
+		var b [2]byte
+		if _, err := io.ReadFull(ws.reader, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	} else if length == 127 {
+		var b [8]byte
+		if _, err := io.ReadFull(ws.reader, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+
+	if opcode >= WEBSOCKET_CLOSE && (!fin || length > 125) {
+		return false, 0, nil, &webSocketError{WEBSOCKET_CLOSE_PROTOCOL_ERROR, "invalid control frame"}
+	}
+	if length > uint64(websocketMaxMessage) {
+		return false, 0, nil, &webSocketError{WEBSOCKET_CLOSE_TOO_BIG, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+func (ws *WebSocket) WriteFrame(opcode byte, payload []byte) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+
+	if ws.closeSent {
+		return errWebSocketClosed
+	}
+	if opcode == WEBSOCKET_CLOSE {
+		ws.closeSent = true
+	}
+
+	header := []byte{0x80 | opcode}
+	if len(payload) < 126 {
+		header = append(header, byte(len(payload)))
+	} else if len(payload) <= 65535 {
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	} else {
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+
+	ws.conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+	buffers := net.Buffers{header, payload}
+	_, err := buffers.WriteTo(ws.conn)
+	return err
+}
+
+func closePayload(code int, reason string) []byte {
+	if code == WEBSOCKET_CLOSE_NO_STATUS {
+		return nil
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// Closes the connection, recording the close code unless one was already
+// recorded.
+func (ws *WebSocket) Finish(code int, reason string) {
+	ws.statusMutex.Lock()
+	if ws.closeCode == 0 {
+		ws.closeCode = code
+		ws.closeReason = reason
+	}
+	ws.statusMutex.Unlock()
+
+	ws.doneOnce.Do(func() {
+		ws.conn.Close()
+		close(ws.done)
+	})
+}
+
+// Closes the connection because something went wrong, letting the client
+// know why if possible.
+func (ws *WebSocket) Fail(code int, reason string) {
+	ws.WriteFrame(WEBSOCKET_CLOSE, closePayload(code, reason))
+	ws.Finish(code, reason)
+}
+
+// Starts the closing handshake, and waits (for a while) for the client to
+// complete it.
+func (ws *WebSocket) Close(code int, reason string) {
+	if ws.WriteFrame(WEBSOCKET_CLOSE, closePayload(code, reason)) == nil {
+		select {
+		case <-ws.done:
+		case <-time.After(WEBSOCKET_CLOSE_TIMEOUT):
+		}
+	}
+	ws.Finish(code, reason)
+}
+
+// Returns the close code and reason, and whether the connection has closed.
+func (ws *WebSocket) Status() (int, string, bool) {
+	ws.statusMutex.Lock()
+	defer ws.statusMutex.Unlock()
+	return ws.closeCode, ws.closeReason, ws.closeCode != 0
+}
+
+// Reads frames from the client until the connection closes, answering pings
+// and queueing up complete messages for Receive.
+func (ws *WebSocket) ReadLoop() {
+	var message []byte
+	messageText := false
+	fragmented := false
+	pinged := false
+
+	for {
+		// Wait for the next frame, pinging the client if it has been quiet
+		// for half the idle timeout, and giving up if it stays quiet.
+		if ws.idleTimeout > 0 {
+			ws.conn.SetReadDeadline(time.Now().Add(ws.idleTimeout / 2))
+		}
+		if _, err := ws.reader.Peek(1); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if !pinged && ws.WriteFrame(WEBSOCKET_PING, nil) == nil {
+					pinged = true
+					continue
+				}
+				ws.Fail(WEBSOCKET_CLOSE_GOING_AWAY, "idle timeout")
+				return
+			}
+			ws.Finish(WEBSOCKET_CLOSE_ABNORMAL, "")
+			return
+		}
+		pinged = false
+
+		// The rest of the frame should follow promptly.
+		if ws.idleTimeout > 0 {
+			ws.conn.SetReadDeadline(time.Now().Add(ws.idleTimeout))
+		}
+		fin, opcode, payload, err := ws.ReadFrame()
+		if err != nil {
+			var wsErr *webSocketError
+			if errors.As(err, &wsErr) {
+				ws.Fail(wsErr.code, wsErr.reason)
+			} else {
+				ws.Finish(WEBSOCKET_CLOSE_ABNORMAL, "")
+			}
+			return
+		}
+
+		switch opcode {
+		case WEBSOCKET_PING:
+			ws.WriteFrame(WEBSOCKET_PONG, payload)
+			continue
+		case WEBSOCKET_PONG:
+			// Only tells us the client is still there
+			continue
+		case WEBSOCKET_CLOSE:
+			code, reason := WEBSOCKET_CLOSE_NO_STATUS, ""
+			if len(payload) == 1 || (len(payload) >= 2 && !utf8.Valid(payload[2:])) {
+				ws.Fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "invalid close frame")
+				return
+			}
+			if len(payload) >= 2 {
+				code, reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+			}
+			// Echo the close back (unless we started the closing handshake)
+			ws.WriteFrame(WEBSOCKET_CLOSE, closePayload(code, ""))
+			ws.Finish(code, reason)
+			return
+		case WEBSOCKET_TEXT, WEBSOCKET_BINARY:
+			if fragmented {
+				ws.Fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "expected continuation frame")
+				return
+			}
+			message, messageText = payload, opcode == WEBSOCKET_TEXT
+		case WEBSOCKET_CONTINUATION:
+			if !fragmented {
+				ws.Fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "unexpected continuation frame")
+				return
+			}
+			if len(message)+len(payload) > websocketMaxMessage {
+				ws.Fail(WEBSOCKET_CLOSE_TOO_BIG, "message too big")
+				return
+			}
+			message = append(message, payload...)
+		default:
+			ws.Fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "unknown opcode")
+			return
+		}
+
+		fragmented = !fin
+		if fragmented {
+			continue
+		}
+		if messageText && !utf8.Valid(message) {
+			ws.Fail(WEBSOCKET_CLOSE_INVALID_DATA, "invalid UTF-8")
+			return
+		}
+
+		select {
+		case ws.messages <- WebSocketMessage{messageText, message}:
+		case <-ws.done:
+			return
+		}
+		message = nil
+	}
+}
+
+// Waits for the next message, up to timeout (if not negative). Returns
+// errWebSocketClosed once the connection has closed and every message has been
+// received.
+func (ws *WebSocket) Receive(timeout time.Duration) (WebSocketMessage, error) {
+	var timer <-chan time.Time
+	if timeout >= 0 {
+		timer = time.After(timeout)
+	}
+
+	select {
+	case m := <-ws.messages:
+		return m, nil
+	case <-ws.done:
+		select {
+		case m := <-ws.messages:
+			return m, nil
+		default:
+			return WebSocketMessage{}, errWebSocketClosed
+		}
+	case <-timer:
+		return WebSocketMessage{}, errWebSocketTimeout
+	}
+}
+
+// Closes every open WebSocket (as the process is shutting down), and waits
+// (for a while) for the applications handling them to finish.
+func CloseWebSockets() {
+	webSocketsMutex.Lock()
+	var open []*WebSocket
+	for _, ws := range webSockets {
+		open = append(open, ws)
+	}
+	webSocketsMutex.Unlock()
+
+	if len(open) == 0 {
+		return
+	}
+	log.Println("Process", process, "closing", len(open), "WebSockets.")
+
+	for _, ws := range open {
+		go ws.Close(WEBSOCKET_CLOSE_GOING_AWAY, "server shutting down")
+	}
+
+	deadline := time.Now().Add(WEBSOCKET_CLOSE_TIMEOUT + WEBSOCKET_FINISH_TIMEOUT)
+	for {
+		webSocketsMutex.Lock()
+		remaining := make([]*WebSocket, 0, len(webSockets))
+		for _, ws := range webSockets {
+			remaining = append(remaining, ws)
+		}
+		webSocketsMutex.Unlock()
+		if len(remaining) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			// Make sure the connections are gone, even if the applications
+			// aren't.
+			for _, ws := range remaining {
+				ws.Finish(WEBSOCKET_CLOSE_GOING_AWAY, "server shutting down")
+			}
+			log.Println("Process", process, "gave up waiting for", len(remaining), "WebSocket tasks to finish.")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Raises a Python exception, returning nil for convenience. Must be called
+// with the GIL held.
+func RaisePythonException(exc *C.PyObject, message string) *C.PyObject {
+	s := C.CString(message)
+	defer C.free(unsafe.Pointer(s))
+	C.PyErr_SetString(exc, s)
+	return nil
+}
+
+func RaiseWebSocketClosed() *C.PyObject {
+	exc := GetWsgoAttribute("WebSocketClosed")
+	defer C.Py_DecRef(exc)
+	return RaisePythonException(exc, "WebSocket is closed")
+}
+
+func PyNone() *C.PyObject {
+	C.Py_IncRef(C.Py_None)
+	return C.Py_None
+}
+
+//export go_websocket_accept
+func go_websocket_accept(request_id C.long, protocol *C.char, protocol_length C.int, idle_timeout C.double) *C.PyObject {
+	timeout := time.Duration(websocketIdleTimeout) * time.Second
+	if idle_timeout >= 0 {
+		timeout = time.Duration(float64(idle_timeout) * float64(time.Second))
+	}
+	protocolName := C.GoStringN(protocol, protocol_length)
+
+	var err error
+	WithoutGIL(func() {
+		_, err = AcceptWebSocket(int64(request_id), protocolName, timeout)
+	})
+	if err != nil {
+		return RaisePythonException(C.PyExc_ValueError, "Couldn't accept WebSocket: "+err.Error())
+	}
+	return PyNone()
+}
+
+//export go_websocket_receive
+func go_websocket_receive(request_id C.long, timeout C.double) *C.PyObject {
+	ws := GetWebSocket(int64(request_id))
+	if ws == nil {
+		return RaiseWebSocketClosed()
+	}
+
+	var message WebSocketMessage
+	var err error
+	WithoutGIL(func() {
+		message, err = ws.Receive(time.Duration(float64(timeout) * float64(time.Second)))
+	})
+
+	if err == errWebSocketTimeout {
+		return RaisePythonException(C.PyExc_TimeoutError, "no WebSocket message received")
+	} else if err != nil {
+		return PyNone()
+	}
+
+	buf := message.data
+	if len(buf) == 0 {
+		buf = []byte{0}
+	}
+	data := (*C.char)(unsafe.Pointer(&buf[0]))
+	size := C.Py_ssize_t(len(message.data))
+	if message.text {
+		return C.PyUnicode_FromStringAndSize(data, size)
+	}
+	return C.PyBytes_FromStringAndSize(data, size)
+}
+
+//export go_websocket_send
+func go_websocket_send(request_id C.long, opcode C.int, data *C.char, data_length C.Py_ssize_t) *C.PyObject {
+	ws := GetWebSocket(int64(request_id))
+	if ws == nil {
+		return RaiseWebSocketClosed()
+	}
+	if opcode == WEBSOCKET_PING && data_length > 125 {
+		return RaisePythonException(C.PyExc_ValueError, "ping data can be at most 125 bytes")
+	}
+
+	// Copy the data while we still hold the GIL
+	payload := C.GoBytes(unsafe.Pointer(data), C.int(data_length))
+
+	var err error
+	WithoutGIL(func() {
+		err = ws.WriteFrame(byte(opcode), payload)
+	})
+	if err == errWebSocketClosed {
+		return RaiseWebSocketClosed()
+	} else if err != nil {
+		ws.Finish(WEBSOCKET_CLOSE_ABNORMAL, "")
+		return RaiseWebSocketClosed()
+	}
+	return PyNone()
+}
+
+//export go_websocket_close
+func go_websocket_close(request_id C.long, code C.int, reason *C.char, reason_length C.int) *C.PyObject {
+	ws := GetWebSocket(int64(request_id))
+	if ws == nil {
+		return PyNone()
+	}
+	if code != WEBSOCKET_CLOSE_NORMAL && (code < 3000 || code > 4999) {
+		return RaisePythonException(C.PyExc_ValueError, "close code must be 1000 or 3000-4999")
+	}
+	if reason_length > 123 {
+		return RaisePythonException(C.PyExc_ValueError, "close reason can be at most 123 bytes")
+	}
+	closeReason := C.GoStringN(reason, reason_length)
+
+	WithoutGIL(func() {
+		ws.Close(int(code), closeReason)
+	})
+	return PyNone()
+}
+
+//export go_websocket_status
+func go_websocket_status(request_id C.long) *C.PyObject {
+	ws := GetWebSocket(int64(request_id))
+	if ws == nil {
+		return PyNone()
+	}
+	code, reason, closed := ws.Status()
+	if !closed {
+		return PyNone()
+	}
+
+	status := C.PyTuple_New(2)
+	C.PyTuple_SetItem(status, 0, C.PyLong_FromLong(C.long(code))) //steals
+	s := C.CString(reason)
+	defer C.free(unsafe.Pointer(s))
+	C.PyTuple_SetItem(status, 1, C.PyUnicode_FromString(s)) //steals
+	return status
+}
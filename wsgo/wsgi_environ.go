@@ -14,11 +14,12 @@ extern PyObject *create_wsgi_input(long request_id);
 */
 import "C"
 
-func CreateWsgiEnvironment(requestId int64, req *http.Request) *C.PyObject {
+func CreateWsgiEnvironment(requestId int64, req *http.Request, mount *Mount) *C.PyObject {
 	environ := C.PyDict_New()
+	scriptName, pathInfo := mount.SplitPath(req.URL.Path)
 	PyDictSet(environ, "REQUEST_METHOD", req.Method)
-	PyDictSet(environ, "SCRIPT_NAME", "")
-	PyDictSet(environ, "PATH_INFO", req.URL.Path)
+	PyDictSet(environ, "SCRIPT_NAME", scriptName)
+	PyDictSet(environ, "PATH_INFO", pathInfo)
 	PyDictSet(environ, "QUERY_STRING", req.URL.RawQuery)
 	PyDictSet(environ, "CONTENT_TYPE", req.Header.Get("Content-type"))
 	PyDictSet(environ, "CONTENT_LENGTH", req.Header.Get("Content-length"))
@@ -31,13 +32,13 @@ func CreateWsgiEnvironment(requestId int64, req *http.Request) *C.PyObject {
 		PyDictSet(environ, "REMOTE_ADDR", host)
 		PyDictSet(environ, "REMOTE_PORT", port)
 	}
-	scheme := req.Header.Get("X-Forwarded-Proto")
-	if scheme == "" {
-		scheme = "http"
-	}
+	scheme := RequestScheme(req)
 	PyDictSet(environ, "wsgi.url_scheme", scheme)
+	if scheme == "https" {
+		PyDictSet(environ, "HTTPS", "on")
+	}
 	multiprocess := C.Py_False
-	if processes > 1 {
+	if IsMultiprocess() {
 		multiprocess = C.Py_True
 	}
 	PyDictSetObject(environ, "wsgi.multiprocess", multiprocess)
@@ -65,6 +66,13 @@ func CreateWsgiEnvironment(requestId int64, req *http.Request) *C.PyObject {
 		PyDictSet(environ, "HTTP_"+k, strings.Join(v, joinStr))
 	}
 
+	if IsWebSocketRequest(req) {
+		// Lets wsgo.websocket() accept the request
+		request_id := C.PyLong_FromLong(C.long(requestId))
+		PyDictSetObject(environ, "wsgo.websocket", request_id)
+		C.Py_DecRef(request_id)
+	}
+
 	wsgi_input := C.create_wsgi_input(C.long(requestId))
 	PyDictSetObject(environ, "wsgi.input", wsgi_input)
 	C.Py_DecRef(wsgi_input)
@@ -77,6 +85,18 @@ func CreateWsgiEnvironment(requestId int64, req *http.Request) *C.PyObject {
 	return environ
 }
 
+// Returns the URL scheme the client used, as reported by any trusted proxies.
+func RequestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		// Came in on one of our own HTTPS sockets
+		return "https"
+	}
+	if _, scheme := ResolveClient(req); scheme == "https" || scheme == "http" {
+		return scheme
+	}
+	return "http"
+}
+
 // from golang cgi
 func upperCaseAndUnderscore(r rune) rune {
 	switch {
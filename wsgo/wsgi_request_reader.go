@@ -45,7 +45,9 @@ func doReadRequest(request_id C.long, to_read C.long, read_line bool) *C.PyObjec
 	requestReadersMutex.Unlock()
 
 	var n int
-	if read_line {
+	if rr == nil {
+		// The request is already over
+	} else if read_line {
 		n, _ = rr.Readline(buf)
 	} else {
 		n, _ = io.ReadFull(rr, buf)